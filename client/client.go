@@ -0,0 +1,973 @@
+// Package client talks to dlock server.
+//
+//	c := client.New(client.Options{Connect: "10.0.0.1:7000"})
+//	defer c.Close()
+//	l, err := c.Lock(ctx, []string{"billing/report"}, &client.LockOptions{Release: time.Minute})
+//	...
+//	defer l.Unlock(ctx)
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is safe for concurrent use. Requests are pipelined on one
+// connection, responses are matched to requests by id. Servers which
+// support it answer each request when it is done, so a Lock waiting
+// for busy keys does not delay other calls. Cluster followers redirect
+// client to leader.
+type Client struct {
+	closed       bool
+	conn         net.Conn       // TCP or unix socket, maybe with TLS on top; nil while disconnected
+	connecting   chan bool      // semaphore of connect
+	detached     time.Time      // when connection of session broke
+	events       []*dlock.Event // pushed by server after Watch
+	eventsErr    error          // connection error, reported by NextEvent after events
+	eventSignal  chan bool
+	heartbeat    time.Duration  // Options.Heartbeat, shortened if server idle timeout is less
+	leader       string         // address of cluster leader from NotLeader, tried first by connect
+	locks        map[*Lock]bool // held by this client
+	nextId       uint64
+	options      Options
+	outOfOrder   bool                  // server answers requests concurrently on current connection
+	pending      map[uint64]chan reply // by request id
+	sessionId    string
+	sessionGrace time.Duration // granted by server, may be less than Options.SessionGrace
+	stop         chan bool     // stops heartbeat and connect
+	w            *bufio.Writer
+	lk           sync.Mutex
+}
+
+type reply struct {
+	conn     net.Conn // which response came from
+	response *dlock.Response
+	err      error
+}
+
+const (
+	maxRedirects  = 5                      // NotLeader responses followed by one call
+	redirectDelay = 200 * time.Millisecond // before retry while cluster has no leader
+)
+
+var (
+	ErrorClientClosed   = errors.New("ClientClosed")
+	ErrorLockLost       = errors.New("LockLost")
+	ErrorNotLeader      = errors.New("NotLeader")
+	ErrorSessionExpired = errors.New("SessionExpired")
+)
+
+// Error status of server response, other than those with own errors above.
+// Status tells busy keys (AcquireTimeout, Deadlock) from failures.
+type StatusError struct {
+	Status    dlock.ResponseStatus
+	ErrorText string              // from server
+	Keys      []string            // failed keys, if server names them
+	Holders   []*dlock.KeyHolders // of busy keys, if server names them
+
+	op string // what was requested, for Error
+}
+
+func newStatusError(response *dlock.Response, format string, args ...interface{}) *StatusError {
+	return &StatusError{
+		Status:    response.GetStatus(),
+		ErrorText: response.GetErrorText(),
+		Keys:      response.Keys,
+		Holders:   response.Holders,
+		op:        fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *StatusError) Error() string {
+	s := fmt.Sprintf("Remote error %s: %s %s", e.op, e.Status.String(), e.ErrorText)
+	if len(e.Keys) > 0 {
+		s += fmt.Sprintf(" failed keys: %v", e.Keys)
+	}
+	if len(e.Holders) > 0 {
+		s += fmt.Sprintf(" holders: %v", e.Holders)
+	}
+	return s
+}
+
+// Creates client with options, zero values replaced by defaults.
+// Connection is established on first call or by Connect.
+func New(options Options) *Client {
+	options.setDefaults()
+	c := &Client{
+		connecting:  make(chan bool, 1),
+		eventSignal: make(chan bool, 1),
+		heartbeat:   options.Heartbeat,
+		locks:       make(map[*Lock]bool),
+		options:     options,
+		pending:     make(map[uint64]chan reply),
+		stop:        make(chan bool),
+	}
+	go c.heartbeatLoop(c.stop)
+	return c
+}
+
+// Closes connection and stops heartbeat. Calls in progress fail.
+// Lost channels of all locks are closed. Without session server
+// releases the locks at once, otherwise when session grace runs out.
+func (c *Client) Close() error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.stop)
+	var err error
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.unsafeDetach(c.conn, ErrorClientClosed)
+	}
+	c.sessionId = ""
+	c.unsafeLoseAll()
+	return err
+}
+
+// Connects to one of Options.Connect addresses: host:port or unix:/path/to.sock.
+// Calls connect on demand, so this is only needed to check server is reachable.
+func (c *Client) Connect(ctx context.Context) error {
+	return c.connect(ctx)
+}
+
+// Tries Options.Connect addresses in turn, unless already connected.
+// Cluster leader named by NotLeader response is tried first.
+// Connection is set up without holding c.lk, so that other calls and
+// Close are not blocked by slow servers. One connect runs at a time.
+func (c *Client) connect(ctx context.Context) error {
+	select {
+	case c.connecting <- true:
+		defer func() { <-c.connecting }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer c.profileTime("Client.connect", time.Now())
+	c.lk.Lock()
+	if c.closed {
+		c.lk.Unlock()
+		return ErrorClientClosed
+	}
+	if c.conn != nil {
+		c.lk.Unlock()
+		return nil
+	}
+	leader, sessionId := c.leader, c.sessionId
+	c.leader = ""
+	c.lk.Unlock()
+
+	// Close stops connecting.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	addresses := strings.Fields(c.options.Connect)
+	err := errors.New("Options.Connect is empty")
+	for i, redirects := 0, 0; ctx.Err() == nil; {
+		address := ""
+		if leader != "" && redirects < maxRedirects {
+			address, leader = leader, ""
+			redirects++
+		} else if i < len(addresses) {
+			address = addresses[i]
+			i++
+		} else {
+			break
+		}
+		h := &handshake{sessionId: sessionId}
+		if err = c.dial(ctx, address, h); err == nil {
+			return c.install(h, sessionId)
+		}
+		leader = h.leader
+		if c.options.Debug {
+			log.Printf("Client.connect: %s: %s", address, err.Error())
+		}
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		return ErrorClientClosed
+	}
+	return c.unsafeConnectFailed(err)
+}
+
+// Makes connection set up by dial current one, unless client is closed
+// or session, which was resumed, has been lost meanwhile.
+func (c *Client) install(h *handshake, resumed string) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.closed {
+		h.conn.Close()
+		return ErrorClientClosed
+	}
+	if c.sessionId != resumed {
+		h.conn.Close()
+		return ErrorSessionExpired
+	}
+	c.conn = h.conn
+	c.w = h.w
+	c.heartbeat = h.heartbeat
+	c.outOfOrder = h.outOfOrder
+	if h.sessionId != "" {
+		c.sessionId = h.sessionId
+		c.sessionGrace = h.sessionGrace
+	}
+	go c.readLoop(h.conn, h.r)
+	return nil
+}
+
+// Connection being set up by dial. Client takes it over in install.
+type handshake struct {
+	conn         net.Conn
+	heartbeat    time.Duration
+	leader       string // from NotLeader response
+	outOfOrder   bool
+	r            *bufio.Reader
+	sessionGrace time.Duration
+	sessionId    string
+	w            *bufio.Writer
+}
+
+func (c *Client) dial(ctx context.Context, address string, h *handshake) error {
+	network := "tcp"
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		network, address = "unix", path
+	}
+	dialer := &net.Dialer{Timeout: c.options.ConnectTimeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err = tcpConn.SetLinger(0); err != nil {
+			conn.Close()
+			return err
+		}
+		if c.options.ReadBuffer != 0 {
+			if err = tcpConn.SetReadBuffer(int(c.options.ReadBuffer)); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+	}
+	if err = c.setup(ctx, conn, h); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Locks of session are lost if server does not know it any more,
+// or grace period granted by server has run out, see resume.
+// This function must be called while holding c.lk lock.
+func (c *Client) unsafeConnectFailed(err error) error {
+	if c.sessionId != "" && (err == ErrorSessionExpired || time.Since(c.detached) >= c.sessionGrace) {
+		log.Printf("Client.connect: %s, session %s is lost", err.Error(), c.sessionId)
+		c.sessionId = ""
+		c.unsafeLoseAll()
+	}
+	return err
+}
+
+func (c *Client) setup(ctx context.Context, conn net.Conn, h *handshake) (err error) {
+	// Server speaks TLS only on TCP, unix socket is protected by file permissions.
+	if _, isTCP := conn.(*net.TCPConn); isTCP && c.options.TLS != nil {
+		tlsConn := tls.Client(conn, c.options.TLS)
+		if err = tlsConn.SetDeadline(time.Now().Add(c.options.ConnectTimeout)); err != nil {
+			return err
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			return err
+		}
+		if err = tlsConn.SetDeadline(time.Time{}); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+
+	h.conn = conn
+	if c.options.ReadBuffer == 0 {
+		h.r = bufio.NewReader(conn)
+	} else {
+		h.r = bufio.NewReaderSize(conn, int(c.options.ReadBuffer))
+	}
+	h.w = bufio.NewWriter(conn)
+
+	// Close or ctx interrupt hello and session exchange.
+	done, stopped := make(chan bool), make(chan bool)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	if err = c.hello(h); err == nil && c.options.SessionGrace != 0 {
+		err = c.openSession(h)
+	}
+	close(done)
+	<-stopped
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// Sends request and reads response before readLoop is started.
+func (c *Client) exchange(h *handshake, request *dlock.Request) (*dlock.Response, error) {
+	c.lk.Lock()
+	c.nextId++
+	request.Id = c.nextId
+	c.lk.Unlock()
+	if err := c.writeTo(h.conn, h.w, request); err != nil {
+		return nil, err
+	}
+	if err := h.conn.SetReadDeadline(time.Now().Add(c.options.ReadTimeout)); err != nil {
+		return nil, err
+	}
+	response := &dlock.Response{}
+	if err := dlock.ReadMessage(h.r, response, c.options.MaxMessage); err != nil {
+		return nil, err
+	}
+	return response, h.conn.SetReadDeadline(time.Time{})
+}
+
+// Introduces client to server and asks to answer requests out of order.
+// Servers which don't know Hello respond InvalidType and keep order of
+// responses. Heartbeat is shortened to a third of server idle timeout.
+func (c *Client) hello(h *handshake) error {
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Hello,
+		Hello: &dlock.RequestHello{
+			Features:       []string{dlock.FeatureOutOfOrder},
+			Name:           c.options.Name,
+			HeartbeatMicro: uint64(c.options.Heartbeat / time.Microsecond),
+		},
+	}
+	response, err := c.exchange(h, request)
+	if err != nil {
+		return err
+	}
+	h.heartbeat = c.options.Heartbeat
+	switch response.GetStatus() {
+	case dlock.ResponseStatus_Ok:
+	case dlock.ResponseStatus_InvalidType:
+		return nil
+	case dlock.ResponseStatus_NotLeader:
+		h.leader = response.GetLeader()
+		return ErrorNotLeader
+	default:
+		return newStatusError(response, "in hello")
+	}
+	for _, feature := range response.Features {
+		if feature == dlock.FeatureOutOfOrder {
+			h.outOfOrder = true
+		}
+	}
+	if idle := time.Duration(response.GetIdleTimeoutMicro()) * time.Microsecond; idle != 0 && idle/3 < h.heartbeat {
+		h.heartbeat = idle / 3
+	}
+	return nil
+}
+
+// Opens new session or resumes the one opened by previous connection.
+func (c *Client) openSession(h *handshake) error {
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Session,
+		Session: &dlock.RequestSession{
+			Id:         h.sessionId,
+			GraceMicro: uint64(c.options.SessionGrace / time.Microsecond),
+		},
+	}
+	response, err := c.exchange(h, request)
+	if err != nil {
+		return err
+	}
+	switch response.GetStatus() {
+	case dlock.ResponseStatus_Ok:
+	case dlock.ResponseStatus_NotLeader:
+		h.leader = response.GetLeader()
+		return ErrorNotLeader
+	case dlock.ResponseStatus_SessionExpired:
+		return ErrorSessionExpired
+	default:
+		return newStatusError(response, "opening session '%s'", h.sessionId)
+	}
+	if c.options.Debug && h.sessionId == "" {
+		log.Printf("Client.openSession: id=%s grace=%dus", response.GetSessionId(), response.GetSessionGraceMicro())
+	}
+	h.sessionId = response.GetSessionId()
+	// Server caps grace at its own limit.
+	h.sessionGrace = time.Duration(response.GetSessionGraceMicro()) * time.Microsecond
+	if h.sessionGrace == 0 {
+		h.sessionGrace = c.options.SessionGrace
+	}
+	return nil
+}
+
+// Acquires keys and returns their handle. Waiting for busy keys is limited
+// by LockOptions.Wait and ctx deadline. nil options take defaults: exclusive
+// lock held until disconnect or session expiration, waiting without limit.
+// If ctx is done first, server is told to cancel the request.
+func (c *Client) Lock(ctx context.Context, keys []string, options *LockOptions) (*Lock, error) {
+	defer c.profileTime("Client.Lock", time.Now())
+	if options == nil {
+		options = &LockOptions{}
+	}
+	wait := options.Wait
+	if deadline, ok := ctx.Deadline(); ok {
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		if wait == 0 || left < wait {
+			wait = left
+		}
+	}
+	mode := dlock.LockMode_Exclusive
+	if options.Shared {
+		mode = dlock.LockMode_Shared
+	}
+
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys:         keys,
+			WaitMicro:    uint64(wait / time.Microsecond),
+			ReleaseMicro: uint64(options.Release / time.Microsecond),
+			Mode:         mode,
+			Limit:        options.Limit,
+			Hierarchical: options.Hierarchical,
+		},
+	}
+	sent := time.Now()
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return nil, newStatusError(response, "locking keys %v", keys)
+	}
+
+	l := newLock(c, keys, response.GetFencingToken())
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if options.Release != 0 {
+		// Server starts lease after receiving request, so this is a bit early.
+		l.timer = time.AfterFunc(sent.Add(options.Release).Sub(time.Now()), func() { c.expire(l) })
+	}
+	c.locks[l] = true
+	return l, nil
+}
+
+// Extends release time of held keys to now+release.
+func (c *Client) extend(ctx context.Context, keys []string, release time.Duration) error {
+	defer c.profileTime("Client.extend", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Extend,
+		Lock: &dlock.RequestLock{
+			Keys:         keys,
+			ReleaseMicro: uint64(release / time.Microsecond),
+		},
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return newStatusError(response, "extending keys %v", keys)
+	}
+	return nil
+}
+
+func (c *Client) unlock(ctx context.Context, keys []string) error {
+	defer c.profileTime("Client.unlock", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Unlock,
+		Lock: &dlock.RequestLock{
+			Keys: keys,
+		},
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return newStatusError(response, "unlocking keys %v", keys)
+	}
+	return nil
+}
+
+func (c *Client) Inspect(ctx context.Context, keys []string) (locks []*dlock.LockInfo, err error) {
+	defer c.profileTime("Client.Inspect", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Inspect,
+		Lock: &dlock.RequestLock{
+			Keys: keys,
+		},
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return nil, newStatusError(response, "inspecting keys %v", keys)
+	}
+
+	return response.Locks, nil
+}
+
+// Returns holders of one page of keys starting with prefix
+// and cursor to get the next page, empty on last page.
+func (c *Client) List(ctx context.Context, prefix string, limit uint32, cursor string) (locks []*dlock.LockInfo, next string, err error) {
+	defer c.profileTime("Client.List", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_List,
+		List: &dlock.RequestList{
+			Prefix: prefix,
+			Limit:  limit,
+			Cursor: cursor,
+		},
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return nil, "", err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return nil, "", newStatusError(response, "listing prefix '%s'", prefix)
+	}
+
+	return response.Locks, response.Cursor, nil
+}
+
+// Subscribes to events of keys and keys starting with prefix,
+// see NextEvent. Empty keys and prefix unsubscribe.
+func (c *Client) Watch(ctx context.Context, keys []string, prefix string) (err error) {
+	defer c.profileTime("Client.Watch", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Watch,
+		Watch: &dlock.RequestWatch{
+			Keys:   keys,
+			Prefix: prefix,
+		},
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return newStatusError(response, "watching keys %v prefix '%s'", keys, prefix)
+	}
+
+	return nil
+}
+
+// Returns next event pushed by server after Watch. Waits until one
+// arrives, connection breaks or ctx is done. Subscription does not
+// survive reconnect, so after connection error call Watch again.
+func (c *Client) NextEvent(ctx context.Context) (*dlock.Event, error) {
+	for {
+		c.lk.Lock()
+		if len(c.events) > 0 {
+			event := c.events[0]
+			c.events = c.events[1:]
+			c.lk.Unlock()
+			return event, nil
+		}
+		if err := c.eventsErr; err != nil {
+			c.eventsErr = nil
+			c.lk.Unlock()
+			return nil, err
+		}
+		c.lk.Unlock()
+
+		select {
+		case <-c.eventSignal:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) Ping(ctx context.Context) (err error) {
+	defer c.profileTime("Client.Ping", time.Now())
+	request := &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Ping,
+	}
+	response, err := c.call(ctx, request)
+	if err != nil {
+		return err
+	}
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		return newStatusError(response, "in ping")
+	}
+	return nil
+}
+
+// Pings server each heartbeat while connected, so that server
+// does not drop connection and broken one is noticed in time.
+func (c *Client) heartbeatLoop(stop <-chan bool) {
+	timer := time.NewTimer(c.options.Heartbeat)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		c.lk.Lock()
+		timer.Reset(c.heartbeat)
+		c.lk.Unlock()
+
+		// Server answering in order would delay ping until pending requests are done.
+		c.lk.Lock()
+		conn := c.conn
+		idle := len(c.pending) == 0 || c.outOfOrder
+		c.lk.Unlock()
+		if conn == nil || !idle {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.options.ReadTimeout)
+		err := c.Ping(ctx)
+		cancel()
+		if err != nil {
+			log.Println("Client.heartbeatLoop: ping error:", err.Error())
+			c.lk.Lock()
+			c.unsafeDetach(conn, err)
+			c.lk.Unlock()
+		}
+	}
+}
+
+// Sends request and waits for response. With session, locks survive
+// reconnect, so on network error request is retried on new connection,
+// which is tried until session is lost. Request answered NotLeader
+// was not done, so it is retried with cluster leader, waiting a bit
+// while there is none.
+// If ctx is done first, pending Lock is cancelled, see abandon.
+func (c *Client) call(ctx context.Context, request *dlock.Request) (*dlock.Response, error) {
+	for retry, redirects := false, 0; ; {
+		ch, err := c.send(ctx, request)
+		sent := err == nil
+		if sent {
+			select {
+			case r := <-ch:
+				if r.err == nil && r.response.GetStatus() != dlock.ResponseStatus_NotLeader {
+					return r.response, nil
+				}
+				err = r.err
+				if err == nil {
+					err = c.redirect(r)
+				}
+			case <-ctx.Done():
+				c.abandon(request, ch)
+				return nil, ctx.Err()
+			}
+		}
+		if err == ErrorNotLeader && redirects < maxRedirects && ctx.Err() == nil {
+			redirects++
+			if err = c.waitLeader(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		c.lk.Lock()
+		resume := c.sessionId != "" && !c.closed
+		c.lk.Unlock()
+		if !resume || ctx.Err() != nil || (sent && retry) {
+			return nil, err
+		}
+		if sent {
+			retry = true
+			log.Printf("Client.call: %s, retrying %s request after reconnect", err.Error(), request.Type.String())
+			continue
+		}
+		// Server is unreachable, maybe cluster is electing new leader.
+		if err = sleep(ctx, redirectDelay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Leaves connection of NotLeader response r for the leader it names.
+func (c *Client) redirect(r reply) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	if c.options.Debug {
+		log.Printf("Client.redirect: %s", r.response.GetErrorText())
+	}
+	c.leader = r.response.GetLeader()
+	c.unsafeDetach(r.conn, ErrorNotLeader)
+	return ErrorNotLeader
+}
+
+// Waits redirectDelay unless leader is known.
+func (c *Client) waitLeader(ctx context.Context) error {
+	c.lk.Lock()
+	known := c.leader != ""
+	c.lk.Unlock()
+	if known {
+		return nil
+	}
+	return sleep(ctx, redirectDelay)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Registers request as pending and sends it, connecting if needed.
+func (c *Client) send(ctx context.Context, request *dlock.Request) (chan reply, error) {
+	for {
+		c.lk.Lock()
+		if c.conn != nil {
+			break
+		}
+		c.lk.Unlock()
+		if err := c.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	defer c.lk.Unlock()
+	ch := make(chan reply, 1)
+	if err := c.write(request); err != nil {
+		c.unsafeDetach(c.conn, err)
+		return nil, err
+	}
+	c.pending[request.Id] = ch
+	return ch, nil
+}
+
+// Assigns request id and writes request.
+// This function must be called while holding c.lk lock.
+func (c *Client) write(request *dlock.Request) error {
+	c.nextId++
+	request.Id = c.nextId
+	return c.writeTo(c.conn, c.w, request)
+}
+
+func (c *Client) writeTo(conn net.Conn, w *bufio.Writer, request *dlock.Request) error {
+	request.AccessToken = c.options.AccessToken
+	if err := conn.SetWriteDeadline(time.Now().Add(c.options.WriteTimeout)); err != nil {
+		return err
+	}
+	if err := dlock.SendMessage(w, request); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Caller of request has gone. Server is asked to cancel pending Lock,
+// and if keys are acquired nevertheless, they are unlocked.
+// Responses to other requests are dropped when they arrive.
+func (c *Client) abandon(request *dlock.Request, ch chan reply) {
+	if request.Type != dlock.RequestType_Lock {
+		return
+	}
+	c.lk.Lock()
+	if c.conn != nil && c.pending[request.Id] == ch {
+		cancel := &dlock.Request{
+			Version: dlock.ProtocolVersion,
+			Type:    dlock.RequestType_Cancel,
+			Cancel:  &dlock.RequestCancel{Id: request.Id},
+		}
+		if err := c.write(cancel); err != nil {
+			c.unsafeDetach(c.conn, err)
+		}
+	}
+	c.lk.Unlock()
+
+	go func() {
+		r := <-ch
+		if r.err == nil && r.response.GetStatus() == dlock.ResponseStatus_Ok {
+			ctx, cancel := context.WithTimeout(context.Background(), c.options.ReadTimeout)
+			defer cancel()
+			if err := c.unlock(ctx, request.Lock.Keys); err != nil {
+				log.Println("Client.abandon: unlock error:", err.Error())
+			}
+		}
+	}()
+}
+
+// Reads responses and events from conn until it breaks.
+func (c *Client) readLoop(conn net.Conn, r *bufio.Reader) {
+	for {
+		response := &dlock.Response{}
+		if err := dlock.ReadMessage(r, response, c.options.MaxMessage); err != nil {
+			c.lk.Lock()
+			c.unsafeDetach(conn, err)
+			c.lk.Unlock()
+			return
+		}
+
+		c.lk.Lock()
+		if response.Event != nil {
+			c.events = append(c.events, response.Event)
+			c.signalEvents()
+		} else if ch, ok := c.pending[response.GetRequestId()]; ok {
+			delete(c.pending, response.GetRequestId())
+			ch <- reply{conn: conn, response: response}
+		} else if c.options.Debug {
+			log.Printf("Client.readLoop: dropped response to request %d: %s",
+				response.GetRequestId(), response.GetStatus().String())
+		}
+		c.lk.Unlock()
+	}
+}
+
+// Closes broken conn, unless it is already replaced, and fails pending requests.
+// Without session, locks are lost. With session, it is resumed in background.
+// This function must be called while holding c.lk lock.
+func (c *Client) unsafeDetach(conn net.Conn, err error) {
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	c.conn = nil
+	c.w = nil
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		ch <- reply{err: err}
+	}
+	c.eventsErr = err
+	c.signalEvents()
+	if c.closed {
+		return
+	}
+	if c.sessionId == "" {
+		c.unsafeLoseAll()
+		return
+	}
+	c.detached = time.Now()
+	go c.resume()
+}
+
+// Reconnects session until it is resumed or lost. New cluster leader
+// may take a few election timeouts to appear. Attempts stop when grace
+// period runs out, so that locks are reported lost in time.
+func (c *Client) resume() {
+	c.lk.Lock()
+	ctx, cancel := context.WithDeadline(context.Background(), c.detached.Add(c.sessionGrace))
+	c.lk.Unlock()
+	defer cancel()
+	for delay := redirectDelay; ; {
+		c.lk.Lock()
+		sessionId := c.sessionId
+		if c.conn != nil || sessionId == "" || c.closed {
+			c.lk.Unlock()
+			return
+		}
+		c.lk.Unlock()
+		log.Printf("Client.resume: resuming session %s", sessionId)
+		err := c.connect(ctx)
+		if err == nil {
+			log.Printf("Client.resume: session %s resumed", sessionId)
+			return
+		}
+		if err = sleep(ctx, delay); err != nil {
+			c.lk.Lock()
+			if c.conn == nil {
+				c.unsafeConnectFailed(err)
+			}
+			c.lk.Unlock()
+			return
+		}
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+}
+
+func (c *Client) signalEvents() {
+	select {
+	case c.eventSignal <- true:
+	default:
+	}
+}
+
+// Lease of l has run out.
+func (c *Client) expire(l *Lock) {
+	l.lose()
+	c.lk.Lock()
+	delete(c.locks, l)
+	c.lk.Unlock()
+}
+
+// This function must be called while holding c.lk lock.
+func (c *Client) unsafeLose(l *Lock) {
+	delete(c.locks, l)
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.lose()
+}
+
+// Returns keys which no held Lock has.
+// This function must be called while holding c.lk lock.
+func (c *Client) unsafeUnheldKeys(keys []string) []string {
+	held := make(map[string]bool)
+	for l := range c.locks {
+		for _, key := range l.Keys {
+			held[key] = true
+		}
+	}
+	unheld := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !held[key] {
+			unheld = append(unheld, key)
+		}
+	}
+	return unheld
+}
+
+// This function must be called while holding c.lk lock.
+func (c *Client) unsafeLoseAll() {
+	for l := range c.locks {
+		c.unsafeLose(l)
+	}
+}
+
+func (c *Client) profileTime(tag string, t1 time.Time) {
+	d := time.Now().Sub(t1)
+	if c.options.Debug {
+		log.Printf("%s time=%s", tag, d)
+	}
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"github.com/temoto/dlock/server"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertNil(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initTestServer(t *testing.T) (*server.Server, string) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	assertNil(err)
+	srv := server.New(server.Options{IdleTimeout: time.Second})
+	go srv.Serve(listener)
+	return srv, listener.Addr().String()
+}
+
+func assertLost(t *testing.T, l *Lock, lost bool) {
+	select {
+	case <-l.Lost():
+		if !lost {
+			t.Fatal("Lock lost:", l.Keys)
+		}
+	default:
+		if lost {
+			t.Fatal("Lock not lost:", l.Keys)
+		}
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	srv, address := initTestServer(t)
+	defer srv.Close()
+	c1 := New(Options{Connect: address})
+	defer c1.Close()
+	c2 := New(Options{Connect: address})
+	defer c2.Close()
+	ctx := context.Background()
+
+	l1, err := c1.Lock(ctx, []string{"a", "b"}, nil)
+	assertNil(err)
+	if l1.FencingToken == 0 {
+		t.Fatal("FencingToken = 0")
+	}
+	if _, err = c2.Lock(ctx, []string{"b"}, &LockOptions{Wait: 10 * time.Millisecond}); err == nil {
+		t.Fatal("Client 2 locked busy key")
+	}
+	// Deadline of ctx limits waiting too.
+	ctxTimeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err = c2.Lock(ctxTimeout, []string{"b"}, nil); err == nil {
+		t.Fatal("Client 2 locked busy key after deadline")
+	}
+	shared, err := c2.Lock(ctx, []string{"c"}, &LockOptions{Shared: true})
+	assertNil(err)
+	assertLost(t, shared, false)
+
+	assertNil(l1.Unlock(ctx))
+	assertLost(t, l1, true)
+	if err = l1.Unlock(ctx); err != ErrorLockLost {
+		t.Fatal("Second Unlock: expected ErrorLockLost, got", err)
+	}
+	l2, err := c2.Lock(ctx, []string{"b"}, &LockOptions{Wait: 10 * time.Millisecond})
+	assertNil(err)
+	if l2.FencingToken <= l1.FencingToken {
+		t.Fatal("Fencing token did not increase:", l1.FencingToken, l2.FencingToken)
+	}
+}
+
+// Server serves TLS only on TCP, so client does not use it for unix socket.
+func TestTLSUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dlock.sock")
+	listener, err := net.Listen("unix", path)
+	assertNil(err)
+	srv := server.New(server.Options{IdleTimeout: time.Second})
+	defer srv.Close()
+	go srv.Serve(listener)
+
+	c := New(Options{Connect: "unix:" + path, TLS: &tls.Config{ServerName: "localhost"}})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l, err := c.Lock(ctx, []string{"a"}, nil)
+	assertNil(err)
+	assertNil(l.Unlock(ctx))
+}
+
+func TestLockLease(t *testing.T) {
+	srv, address := initTestServer(t)
+	defer srv.Close()
+	c := New(Options{Connect: address})
+	defer c.Close()
+
+	l, err := c.Lock(context.Background(), []string{"a"}, &LockOptions{Release: 30 * time.Millisecond})
+	assertNil(err)
+	time.Sleep(15 * time.Millisecond)
+	assertNil(l.Extend(context.Background(), 30*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	assertLost(t, l, false)
+
+	select {
+	case <-l.Lost():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Lock not lost after lease")
+	}
+	if err = l.Extend(context.Background(), time.Second); err != ErrorLockLost {
+		t.Fatal("Extend after lease: expected ErrorLockLost, got", err)
+	}
+}
+
+// Local lease timer fires while Extend waits behind Lock of the same key.
+func TestLockExtendAfterExpire(t *testing.T) {
+	srv, address := initTestServer(t)
+	defer srv.Close()
+	c := New(Options{Connect: address})
+	defer c.Close()
+	c2 := New(Options{Connect: address})
+	defer c2.Close()
+	ctx := context.Background()
+
+	l, err := c.Lock(ctx, []string{"a"}, &LockOptions{Release: 10 * time.Second})
+	assertNil(err)
+	_, err = c2.Lock(ctx, []string{"b"}, nil)
+	assertNil(err)
+	c.lk.Lock()
+	l.timer.Stop()
+	l.timer = time.AfterFunc(10*time.Millisecond, func() { c.expire(l) })
+	c.lk.Unlock()
+	go c.Lock(ctx, []string{"a", "b"}, &LockOptions{Wait: 50 * time.Millisecond})
+	time.Sleep(5 * time.Millisecond)
+
+	if err = l.Extend(ctx, 10*time.Second); err != ErrorLockLost {
+		t.Fatal("Extend after local expiration: expected ErrorLockLost, got", err)
+	}
+	locks, err := c2.Inspect(ctx, []string{"a"})
+	assertNil(err)
+	if len(locks) != 1 || locks[0].ClientId != "" {
+		t.Fatal("Key extended after local expiration is held:", locks)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	srv, address := initTestServer(t)
+	defer srv.Close()
+	c1 := New(Options{Connect: address})
+	defer c1.Close()
+	c2 := New(Options{Connect: address})
+	defer c2.Close()
+	ctx := context.Background()
+	status := func(err error) dlock.ResponseStatus {
+		e, ok := err.(*StatusError)
+		if !ok {
+			t.Fatal("Expected StatusError, got", err)
+		}
+		return e.Status
+	}
+
+	_, err := c1.Lock(ctx, []string{"a"}, nil)
+	assertNil(err)
+	_, err = c2.Lock(ctx, []string{"b"}, nil)
+	assertNil(err)
+	_, err = c2.Lock(ctx, []string{"a"}, &LockOptions{Wait: 10 * time.Millisecond})
+	if s := status(err); s != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Lock of busy key: expected AcquireTimeout, got", s)
+	}
+	if e := err.(*StatusError); len(e.Keys) != 1 || e.Keys[0] != "a" {
+		t.Fatal("AcquireTimeout failed keys:", e.Error())
+	}
+	if s := status(c1.extend(ctx, []string{"c"}, time.Second)); s != dlock.ResponseStatus_NotLocked {
+		t.Fatal("Extend of not held key: expected NotLocked, got", s)
+	}
+
+	// Each client waits for key of the other.
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := c1.Lock(ctx, []string{"b"}, &LockOptions{Wait: time.Second})
+		waiting <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err = c2.Lock(ctx, []string{"a"}, &LockOptions{Wait: time.Second})
+	if s := status(err); s != dlock.ResponseStatus_Deadlock {
+		t.Fatal("Lock closing cycle: expected Deadlock, got", s)
+	}
+}
+
+func TestLockLostOnDisconnect(t *testing.T) {
+	srv, address := initTestServer(t)
+	c := New(Options{Connect: address, Heartbeat: 5 * time.Millisecond})
+	defer c.Close()
+
+	l, err := c.Lock(context.Background(), []string{"a"}, nil)
+	assertNil(err)
+	assertLost(t, l, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assertNil(srv.Shutdown(ctx))
+
+	// Heartbeat notices broken connection.
+	select {
+	case <-l.Lost():
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Lock not lost after disconnect")
+	}
+}
+
+func TestSessionGrace(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	assertNil(err)
+	srv := server.New(server.Options{IdleTimeout: time.Second, SessionGrace: 50 * time.Millisecond})
+	go srv.Serve(listener)
+	c := New(Options{Connect: listener.Addr().String(), Heartbeat: 5 * time.Millisecond, SessionGrace: time.Minute})
+	defer c.Close()
+
+	l, err := c.Lock(context.Background(), []string{"a"}, nil)
+	assertNil(err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assertNil(srv.Shutdown(ctx))
+
+	// Server has granted less than asked, its keys are released by then.
+	select {
+	case <-l.Lost():
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Lock not lost after granted session grace")
+	}
+}
+
+func TestCloseWhileConnecting(t *testing.T) {
+	// Server accepts connection, but never answers hello.
+	listener, err := net.Listen("tcp", "localhost:0")
+	assertNil(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	c := New(Options{Connect: listener.Addr().String()})
+
+	result := make(chan error, 1)
+	go func() { result <- c.Connect(context.Background()) }()
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan bool)
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Close blocked by connect")
+	}
+	select {
+	case err = <-result:
+		if err != ErrorClientClosed {
+			t.Fatal("Connect: expected ErrorClientClosed, got", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Connect not stopped by Close")
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	srv, address := initTestServer(t)
+	defer srv.Close()
+	c1 := New(Options{Connect: address})
+	defer c1.Close()
+	c2 := New(Options{Connect: address})
+	defer c2.Close()
+	ctx := context.Background()
+
+	l1, err := c1.Lock(ctx, []string{"a"}, nil)
+	assertNil(err)
+	l2, err := c2.Lock(ctx, []string{"b"}, nil)
+	assertNil(err)
+
+	// Server answers other requests while Lock waits.
+	ctxCancel, cancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		ctxPing, cancelPing := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancelPing()
+		if err := c2.Ping(ctxPing); err != nil {
+			t.Error("Ping while Lock waits:", err)
+		}
+		cancel()
+	}()
+	if _, err = c2.Lock(ctxCancel, []string{"a"}, nil); err != context.Canceled {
+		t.Fatal("Lock: expected context.Canceled, got", err)
+	}
+	// Connection and other locks are intact.
+	assertLost(t, l2, false)
+	assertNil(l1.Unlock(ctx))
+	assertNil(c2.Ping(ctx))
+	assertLost(t, l2, false)
+
+	// Cancelled request does not keep the key.
+	c3 := New(Options{Connect: address})
+	defer c3.Close()
+	_, err = c3.Lock(ctx, []string{"a"}, &LockOptions{Wait: 50 * time.Millisecond})
+	assertNil(err)
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	listeners := make([]net.Listener, 3)
+	addresses := make([]string, 3)
+	peers := make([]string, 3)
+	for i := range listeners {
+		listeners[i], err = net.Listen("tcp", "127.0.0.1:0")
+		assertNil(err)
+		addresses[i] = listeners[i].Addr().String()
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assertNil(err)
+		peers[i] = l.Addr().String()
+		l.Close()
+	}
+	servers := make([]*server.Server, 3)
+	for i, l := range listeners {
+		servers[i] = server.New(server.Options{
+			Cluster:          strings.Join(peers, " "),
+			ClusterAdvertise: addresses[i],
+			ClusterBind:      peers[i],
+			ClusterSecret:    "test",
+			DataDir:          filepath.Join(dir, fmt.Sprint(i)),
+			ElectionTimeout:  50 * time.Millisecond,
+			IdleTimeout:      time.Second,
+			SessionGrace:     time.Second,
+		})
+		go servers[i].Serve(l)
+		defer servers[i].Shutdown(context.Background())
+	}
+
+	// Client finds leader among followers, even while it is being elected.
+	c := New(Options{Connect: strings.Join(addresses, " "), Heartbeat: 20 * time.Millisecond, SessionGrace: time.Second})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	l, err := c.Lock(ctx, []string{"a"}, nil)
+	assertNil(err)
+
+	// Session and its lock survive failure of leader.
+	c.lk.Lock()
+	leader := c.conn.RemoteAddr().String()
+	c.lk.Unlock()
+	for i, address := range addresses {
+		if address == leader {
+			assertNil(servers[i].Shutdown(ctx))
+		}
+	}
+	assertNil(c.Ping(ctx))
+	assertLost(t, l, false)
+	assertNil(l.Unlock(ctx))
+}
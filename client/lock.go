@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Handle of keys acquired by Client.Lock.
+type Lock struct {
+	FencingToken uint64
+	Keys         []string
+
+	client   *Client
+	lost     chan bool
+	lostOnce sync.Once
+	timer    *time.Timer // lease expiration, nil without release time
+}
+
+func newLock(c *Client, keys []string, token uint64) *Lock {
+	return &Lock{
+		FencingToken: token,
+		Keys:         append([]string(nil), keys...),
+
+		client: c,
+		lost:   make(chan bool),
+	}
+}
+
+// Returns channel which is closed when keys are no longer held:
+// lease has run out, connection broke without session, session
+// could not be resumed, or after Unlock or Client.Close.
+func (l *Lock) Lost() <-chan bool {
+	return l.lost
+}
+
+// Releases keys. Lost channel is closed even if request fails.
+func (l *Lock) Unlock(ctx context.Context) error {
+	c := l.client
+	if !l.held() {
+		return ErrorLockLost
+	}
+	err := c.unlock(ctx, l.Keys)
+	c.lk.Lock()
+	c.unsafeLose(l)
+	c.lk.Unlock()
+	return err
+}
+
+// Sets release time of keys to now+release. Locks acquired without
+// release time are held until disconnect, server leaves them as is.
+// If lease runs out while request is in flight, Lost is closed already,
+// so keys extended by server are unlocked and ErrorLockLost is returned.
+func (l *Lock) Extend(ctx context.Context, release time.Duration) error {
+	c := l.client
+	if !l.held() {
+		return ErrorLockLost
+	}
+	sent := time.Now()
+	if err := c.extend(ctx, l.Keys, release); err != nil {
+		return err
+	}
+	c.lk.Lock()
+	if l.timer == nil || l.timer.Stop() {
+		if l.timer != nil {
+			l.timer.Reset(sent.Add(release).Sub(time.Now()))
+		}
+		c.lk.Unlock()
+		return nil
+	}
+	// Keys locked again by other handle stay held.
+	keys := c.unsafeUnheldKeys(l.Keys)
+	c.lk.Unlock()
+	if len(keys) > 0 {
+		if err := c.unlock(ctx, keys); err != nil {
+			log.Println("Lock.Extend: unlock after expiration:", err.Error())
+		}
+	}
+	return ErrorLockLost
+}
+
+func (l *Lock) held() bool {
+	l.client.lk.Lock()
+	defer l.client.lk.Unlock()
+	return l.client.locks[l]
+}
+
+func (l *Lock) lose() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"crypto/tls"
+	"time"
+)
+
+// Client settings. Zero values mean defaults, see New.
+type Options struct {
+	AccessToken    string
+	Connect        string        // host:port or unix:/path/to.sock, space separated addresses of cluster nodes
+	ConnectTimeout time.Duration // default 10s
+	Debug          bool
+	Heartbeat      time.Duration // ping server this often while connected, default 20s; shortened to a third of server idle timeout
+	MaxMessage     uint          // default 16KB
+	Name           string        // of client program, sent to server for logs
+	ReadBuffer     uint
+	ReadTimeout    time.Duration // maximum time to wait for heartbeat and session responses, default 10s
+	SessionGrace   time.Duration // 0 means locks are released on disconnect
+	TLS            *tls.Config   // for TCP addresses, nil means plain connection
+	WriteTimeout   time.Duration // default 10s
+}
+
+// Options of a single Lock call.
+type LockOptions struct {
+	Hierarchical bool          // conflict with locks on '/' separated ancestor and descendant keys
+	Limit        uint32        // >0 makes Shared lock a counting semaphore
+	Release      time.Duration // lease time, 0 holds locks until disconnect or session expiration
+	Shared       bool
+	Wait         time.Duration // maximum time to wait for busy keys, 0 waits until ctx deadline or forever
+}
+
+func (options *Options) setDefaults() {
+	if options.ConnectTimeout == 0 {
+		options.ConnectTimeout = 10 * time.Second
+	}
+	if options.Heartbeat == 0 {
+		options.Heartbeat = 20 * time.Second
+	}
+	if options.MaxMessage == 0 {
+		options.MaxMessage = 16 << 10
+	}
+	if options.ReadTimeout == 0 {
+		options.ReadTimeout = 10 * time.Second
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = 10 * time.Second
+	}
+}
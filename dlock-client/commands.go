@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/temoto/dlock/client"
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Prints holders of keys, returns exit code.
+func runInspect(c *client.Client, keys []string) int {
+	if len(keys) == 0 {
+		log.Println("inspect: no keys given.")
+		return 2
+	}
+	locks, err := c.Inspect(context.Background(), keys)
+	if err != nil {
+		log.Println("main: Client.Inspect:", err.Error())
+		return 1
+	}
+	printLocks(locks)
+	return 0
+}
+
+// Prints holders of all keys starting with prefix, returns exit code.
+func runList(c *client.Client, prefix string) int {
+	locks := make([]*dlock.LockInfo, 0)
+	cursor := ""
+	for {
+		page, next, err := c.List(context.Background(), prefix, 0, cursor)
+		if err != nil {
+			log.Println("main: Client.List:", err.Error())
+			return 1
+		}
+		locks = append(locks, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	printLocks(locks)
+	return 0
+}
+
+// Prints events of keys and keys starting with prefix until interrupted.
+// Returns exit code.
+func runWatch(c *client.Client, keys []string, prefix string) int {
+	if len(keys) == 0 && prefix == "" {
+		log.Println("watch: no keys or -prefix given.")
+		return 2
+	}
+	if err := c.Watch(context.Background(), keys, prefix); err != nil {
+		log.Println("main: Client.Watch:", err.Error())
+		return 1
+	}
+	for {
+		event, err := c.NextEvent(context.Background())
+		if err != nil {
+			log.Println("main: Client.NextEvent:", err.Error())
+			return 1
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%d\n", formatUnixNano(event.Time), event.Type.String(),
+			event.Key, event.ClientId, event.Mode.String(), event.FencingToken)
+	}
+}
+
+func printLocks(locks []*dlock.LockInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCLIENT\tIDENTITY\tMODE\tCREATED\tEXPIRES\tWAITERS\tTOKEN")
+	for _, info := range locks {
+		if info.ClientId == "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t%d\t-\n", info.Key, info.Waiters)
+			continue
+		}
+		identity := info.Identity
+		if identity == "" {
+			identity = "-"
+		}
+		expires := "disconnect"
+		if info.Expires != 0 {
+			expires = formatUnixNano(info.Expires)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", info.Key, info.ClientId, identity, info.Mode.String(),
+			formatUnixNano(info.Created), expires, info.Waiters, info.FencingToken)
+	}
+	w.Flush()
+}
+
+func formatUnixNano(t int64) string {
+	return time.Unix(0, t).Format(time.RFC3339Nano)
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/temoto/dlock/client"
 	"github.com/temoto/dlock/dlock"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,18 +25,31 @@ import (
 func main() {
 	var (
 		flagAutoKey        = flag.String("auto-key", "", "Prepend this string to full command including all arguments and use it as key. Auto key is appended to -keys.")
-		flagConnect        = flag.String("connect", "", "Connect to Dlock server at this address:port")
+		flagConnect        = flag.String("connect", "", "Connect to Dlock server at this address:port or unix:/path/to.sock. Space separated addresses of cluster nodes are tried in turn")
 		flagConnectTimeout = flag.Duration("connect-timeout", 10*time.Second, "Maximum time to establish TCP connection with server")
 		flagDebug          = flag.Bool("debug", false, "Debug logging")
-		flagExec           = flag.String("exec", "", "Command to execute")
+		flagExec           = flag.String("exec", "", "Shell command to execute while locks are held, run by sh -c with standard input and output of dlock-client. Fencing token of acquired locks is passed in DLOCK_FENCING_TOKEN environment variable.")
+		flagHeartbeat      = flag.Duration("heartbeat", 0, "Ping server this often while connected, to keep connection alive and notice when it breaks. Default is a third of -idle-timeout.")
+		flagHierarchical   = flag.Bool("hierarchical", false, "Treat keys as '/' separated paths: lock also conflicts with locks on parent and child paths.")
 		flagHold           = flag.Duration("hold", 0, "Hold locks at least this time even if child process finishes earlier")
-		flagIdleTimeout    = flag.Duration("idle-timeout", 30*time.Second, "Maximum time to wait for beginning of server response")
-		flagKeys           = flag.String("keys", "", "Keys to lock (space separated).")
+		flagIdleTimeout    = flag.Duration("idle-timeout", 30*time.Second, "Maximum time connection stays without requests, see -heartbeat")
+		flagKeys           = flag.String("keys", "", "Keys to lock or inspect (space separated).")
+		flagLimit          = flag.Uint("limit", 0, "Use keys as counting semaphores: at most this many clients may hold each key at once.")
 		flagLockRelease    = flag.Duration("lock-release", 0, "Tell server to hold lock for exactly this time. In this mode no implicit unlocking at disconnect is performed.")
+		flagLockRenew      = flag.Bool("lock-renew", false, "Keep extending -lock-release time while -exec program runs.")
 		flagLockWait       = flag.Duration("lock-wait", 0, "Lock acquire timeout")
 		flagMaxMessage     = flag.Uint("max-message", 16<<10, "Maximum message length accepted by client. If server sends more - we disconnect.")
+		flagPrefix         = flag.String("prefix", "", "Key prefix for watch command")
 		flagReadBuffer     = flag.Uint("read-buffer", 0, "Read buffer size for sockets")
 		flagReadTimeout    = flag.Duration("read-timeout", 10*time.Second, "Maximum time to receive a single message")
+		flagSessionGrace   = flag.Duration("session-grace", 0, "Open session: if connection breaks, server keeps locks for this time and client reconnects to resume it.")
+		flagShared         = flag.Bool("shared", false, "Acquire shared (read) locks. Shared locks coexist with each other, but not with exclusive ones.")
+		flagTLS            = flag.Bool("tls", false, "Connect to server using TLS")
+		flagTLSCA          = flag.String("tls-ca", "", "Verify server certificate with CAs from this PEM file instead of system ones. Implies -tls.")
+		flagTLSCert        = flag.String("tls-cert", "", "Present this PEM client certificate to server. Requires -tls-key, implies -tls.")
+		flagTLSKey         = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+		flagToken          = flag.String("token", "", "Access token. Default is contents of -token-file or DLOCK_TOKEN environment variable.")
+		flagTokenFile      = flag.String("token-file", "", "Read access token from this file")
 		flagWriteTimeout   = flag.Duration("write-timeout", 10*time.Second, "Maximum time to send a single message")
 	)
 	flag.Parse()
@@ -37,40 +59,75 @@ func main() {
 
 	dlock.Debug = *flagDebug
 
-	client := NewClient(*flagConnect, *flagIdleTimeout)
-	client.ConfigAutoKey = *flagAutoKey
-	client.ConfigConnectTimeout = *flagConnectTimeout
-	client.ConfigExec = *flagExec
-	client.ConfigDebug = *flagDebug
-	client.ConfigHold = *flagHold
-	client.ConfigKeys = client.parseKeys(*flagKeys)
-	client.ConfigLockRelease = *flagLockRelease
-	client.ConfigLockWait = *flagLockWait
-	client.ConfigMaxMessage = *flagMaxMessage
-	client.ConfigReadBuffer = *flagReadBuffer
-	client.ConfigReadTimeout = *flagReadTimeout
-	client.ConfigWriteTimeout = *flagWriteTimeout
-
-	if len(client.ConfigAutoKey) == 0 && len(client.ConfigKeys) == 0 {
+	if *flagHeartbeat == 0 {
+		*flagHeartbeat = *flagIdleTimeout / 3
+	}
+
+	options := client.Options{
+		AccessToken:    readToken(*flagToken, *flagTokenFile),
+		Connect:        *flagConnect,
+		ConnectTimeout: *flagConnectTimeout,
+		Debug:          *flagDebug,
+		Heartbeat:      *flagHeartbeat,
+		MaxMessage:     *flagMaxMessage,
+		Name:           "dlock-client",
+		ReadBuffer:     *flagReadBuffer,
+		ReadTimeout:    *flagReadTimeout,
+		SessionGrace:   *flagSessionGrace,
+		WriteTimeout:   *flagWriteTimeout,
+	}
+	if *flagTLS || *flagTLSCA != "" || *flagTLSCert != "" {
+		config, err := tlsConfig(*flagConnect, *flagTLSCA, *flagTLSCert, *flagTLSKey)
+		if err != nil {
+			log.Fatalln("main: TLS config:", err.Error())
+		}
+		options.TLS = config
+	}
+	c := client.New(options)
+	keys := parseKeys(*flagKeys)
+
+	// Commands other than lock only query server and exit.
+	switch flag.Arg(0) {
+	case "", "lock":
+	case "inspect":
+		os.Exit(runInspect(c, append(keys, flag.Args()[1:]...)))
+	case "list":
+		os.Exit(runList(c, flag.Arg(1)))
+	case "watch":
+		os.Exit(runWatch(c, append(keys, flag.Args()[1:]...), *flagPrefix))
+	default:
+		log.Fatalln("Unknown command:", flag.Arg(0), "Known commands: lock (default), inspect, list, watch.")
+	}
+
+	if len(*flagAutoKey) == 0 && len(keys) == 0 {
 		log.Fatalln("One of -auto-key or -keys is mandatory.")
 	}
-	if client.ConfigExec == "" && client.ConfigHold == 0 {
+	if *flagExec == "" && *flagHold == 0 {
 		log.Fatalln("One of -exec or -hold is mandatory.")
 	}
+	if *flagLockRenew && *flagLockRelease == 0 {
+		log.Fatalln("-lock-renew requires -lock-release.")
+	}
 
 	sigIntChan := make(chan os.Signal, 1)
 	signal.Notify(sigIntChan, syscall.SIGINT)
 	go func() {
 		<-sigIntChan
-		client.Close(0)
+		c.Close()
 	}()
 
-	err := client.Connect()
+	err := c.Connect(context.Background())
 	if err != nil {
 		log.Fatalln("main: Client.Connect:", err.Error())
 	}
 
-	err = client.Lock(client.ConfigKeys, client.ConfigLockWait, *maxDuration(&client.ConfigHold, &client.ConfigLockRelease))
+	lock, err := c.Lock(context.Background(), keys, &client.LockOptions{
+		Hierarchical: *flagHierarchical,
+		Limit:        uint32(*flagLimit),
+		Release:      *maxDuration(flagHold, flagLockRelease),
+		Shared:       *flagShared,
+		Wait:         *flagLockWait,
+	})
 	if err != nil {
 		log.Fatalln("main: Client.Lock:", err.Error())
 	}
@@ -78,14 +135,14 @@ func main() {
 	exitCode := 0
 	stopWait := sync.WaitGroup{}
 
-	if client.ConfigHold != 0 {
+	if *flagHold != 0 {
 		stopWait.Add(1)
 		go func() {
-			time.Sleep(client.ConfigHold)
+			time.Sleep(*flagHold)
 			stopWait.Done()
 		}()
 	}
-	if client.ConfigExec != "" {
+	if *flagExec != "" {
 		stopWait.Add(1)
 		go func() {
 			defer stopWait.Done()
@@ -93,12 +150,20 @@ func main() {
 			if err != nil {
 				log.Fatalln("sh is required to run -exec program. Error:", err.Error())
 			}
-			attr := &os.ProcAttr{}
-			p, err := os.StartProcess(aname, []string{client.ConfigExec}, attr)
+			attr := &os.ProcAttr{
+				Env:   append(os.Environ(), fmt.Sprintf("DLOCK_FENCING_TOKEN=%d", lock.FencingToken)),
+				Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+			}
+			p, err := os.StartProcess(aname, []string{"sh", "-c", *flagExec}, attr)
 			if err != nil {
 				log.Fatalln(err.Error())
 			}
+			stopRenew := make(chan bool)
+			if *flagLockRenew {
+				go renewLoop(lock, *flagLockRelease, stopRenew)
+			}
 			state, err := p.Wait()
+			close(stopRenew)
 			if err != nil {
 				log.Fatalln(err.Error())
 			}
@@ -110,10 +175,102 @@ func main() {
 
 	stopWait.Wait()
 
-	// client.Wait()
+	// With session, server would keep keys for grace period after exit.
+	// Leases set by -hold or -lock-release are held for exactly that time.
+	if *maxDuration(flagHold, flagLockRelease) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *flagReadTimeout)
+		if err := lock.Unlock(ctx); err != nil && err != client.ErrorLockLost {
+			log.Println("main: Lock.Unlock:", err.Error())
+		}
+		cancel()
+	}
+	c.Close()
 	os.Exit(exitCode)
 }
 
+// Extends lock each third of release time until stop is closed or lock is lost.
+// Client heartbeat keeps connection alive, so that broken one is noticed
+// and session is resumed before it expires.
+func renewLoop(lock *client.Lock, release time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(release / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-lock.Lost():
+			log.Println("main: lock lost")
+			return
+		case <-ticker.C:
+			if err := lock.Extend(context.Background(), release); err != nil {
+				log.Println("main: Lock.Extend:", err.Error())
+				return
+			}
+		}
+	}
+}
+
+// Builds client TLS config. Server name is the host part of the first TCP
+// connect address, unix sockets are not wrapped in TLS.
+func tlsConfig(connect, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	for _, address := range strings.Fields(connect) {
+		if strings.HasPrefix(address, "unix:") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		config.ServerName = host
+		break
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Returns access token from flag, file or environment, in this order.
+func readToken(token, path string) string {
+	if token != "" {
+		return token
+	}
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalln("main: read -token-file:", err.Error())
+		}
+		return strings.TrimSpace(string(b))
+	}
+	return os.Getenv("DLOCK_TOKEN")
+}
+
+func parseKeys(in string) []string {
+	out := make([]string, 0, len(in)/10)
+	for _, key := range strings.Split(in, " ") {
+		key = strings.TrimSpace(key)
+		if len(key) > 0 {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
 func maxDuration(d1, d2 *time.Duration) *time.Duration {
 	if *d1 >= *d2 {
 		return d1
@@ -1,25 +1,54 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/temoto/dlock/dlock"
+	"github.com/temoto/dlock/server"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
 	var (
-		flagBind         = flag.String("bind", "", "Bind to these address:port pairs")
-		flagDebug        = flag.Bool("debug", false, "Enable debug logging")
-		flagIdleTimeout  = flag.Duration("idle-timeout", 60*time.Second, "Disconnect clients without any activity within this time")
-		flagReadTimeout  = flag.Duration("read-timeout", 10*time.Second, "Maximum time to receive a single message")
-		flagWriteTimeout = flag.Duration("write-timeout", 10*time.Second, "Maximum time to send a single message")
-		flagMaxMessage   = flag.Uint("max-message", 16<<10, "Maximum message length accepted by server. Clients trying to send more will be disconnected")
-		flagReadBuffer   = flag.Uint("read-buffer", 0, "Read buffer size for sockets")
+		flagACLFile          = flag.String("acl-file", "", "Allow access to keys only by rules in this file, one 'identity operations globs...' rule per line")
+		flagBind             = flag.String("bind", "", "Bind to these address:port pairs and unix:/path/to.sock sockets")
+		flagCluster          = flag.String("cluster", "", "Replicate locks among these space separated address:port of all cluster nodes. Requires -cluster-bind, -cluster-secret-file and -data-dir. Nodes trust each other fully: any node may rewrite the lock table, so they prove to each other that they know the secret. Traffic between them is not encrypted, keep it on a private network")
+		flagClusterAdvertise = flag.String("cluster-advertise", "", "Followers redirect clients to this address of leader, default is the first -bind address")
+		flagClusterBind      = flag.String("cluster-bind", "", "Address:port of this node for other cluster nodes, one of -cluster")
+		flagClusterSecret    = flag.String("cluster-secret-file", "", "Read secret shared by all cluster nodes from this file")
+		flagDataDir          = flag.String("data-dir", "", "Keep journal of lease locks, or cluster log with -cluster, in this directory and restore them on start")
+		flagDebug            = flag.Bool("debug", false, "Enable debug logging")
+		flagElectionTimeout  = flag.Duration("election-timeout", time.Second, "Cluster nodes elect new leader after not hearing from it this long")
+		flagFsync            = flag.String("fsync", "interval", "Flush journal to disk: always (before each response), interval or never (left to OS)")
+		flagFsyncInterval    = flag.Duration("fsync-interval", time.Second, "Flush journal to disk this often with -fsync interval")
+		flagIdleTimeout      = flag.Duration("idle-timeout", 60*time.Second, "Disconnect clients without any activity within this time")
+		flagKeyChars         = flag.String("key-chars", "", "Allow only these characters and ranges in keys, like 'a-zA-Z0-9/_.-'")
+		flagMaxClientKeys    = flag.Uint("max-client-keys", 0, "Maximum keys held and waited for by one client, 0 means no limit")
+		flagMaxInflight      = flag.Uint("max-inflight", 100, "Maximum concurrent requests per connection with out of order responses")
+		flagMaxKeyLength     = flag.Uint("max-key-length", 0, "Maximum key length in bytes, 0 means no limit")
+		flagMaxKeys          = flag.Uint("max-keys", 0, "Maximum keys in one lock request, 0 means no limit")
+		flagMaxMessage       = flag.Uint("max-message", 16<<10, "Maximum message length accepted by server. Clients trying to send more will be disconnected")
+		flagReadBuffer       = flag.Uint("read-buffer", 0, "Read buffer size for sockets")
+		flagReadTimeout      = flag.Duration("read-timeout", 10*time.Second, "Maximum time to receive a single message")
+		flagSessionGrace     = flag.Duration("session-grace", time.Minute, "Maximum time to keep locks of disconnected session until client reconnects")
+		flagShutdownTimeout  = flag.Duration("shutdown-timeout", 5*time.Second, "On SIGINT, wait this long for connections to finish")
+		flagSnapshotInterval = flag.Duration("snapshot-interval", time.Minute, "Write snapshot of lease locks and truncate journal this often")
+		flagTLSCert          = flag.String("tls-cert", "", "Serve TLS with this PEM certificate file. Requires -tls-key")
+		flagTLSClientCA      = flag.String("tls-client-ca", "", "Require client certificates signed by CAs from this PEM file")
+		flagTLSClientId      = flag.Bool("tls-client-identity", false, "Use subject common name of client certificate as client identity")
+		flagTLSKey           = flag.String("tls-key", "", "PEM private key file for -tls-cert")
+		flagTokensFile       = flag.String("tokens-file", "", "Require access tokens listed in this file, one 'identity token' pair per line")
+		flagUnixGroup        = flag.String("unix-group", "", "Group of unix socket files")
+		flagUnixMode         = flag.String("unix-mode", "0660", "Permissions of unix socket files, octal")
+		flagWriteTimeout     = flag.Duration("write-timeout", 10*time.Second, "Maximum time to send a single message")
 	)
 	flag.Parse()
 
@@ -28,18 +57,78 @@ func main() {
 
 	dlock.Debug = *flagDebug
 
-	server := NewServer(*flagBind, *flagIdleTimeout)
-	server.ConfigDebug = *flagDebug
-	server.ConfigMaxMessage = *flagMaxMessage
-	server.ConfigReadBuffer = *flagReadBuffer
-	server.ConfigReadTimeout = *flagReadTimeout
-	server.ConfigWriteTimeout = *flagWriteTimeout
+	options := server.Options{
+		Bind:              *flagBind,
+		Cluster:           *flagCluster,
+		ClusterAdvertise:  *flagClusterAdvertise,
+		ClusterBind:       *flagClusterBind,
+		DataDir:           *flagDataDir,
+		Debug:             *flagDebug,
+		ElectionTimeout:   *flagElectionTimeout,
+		FsyncInterval:     *flagFsyncInterval,
+		IdleTimeout:       *flagIdleTimeout,
+		MaxClientKeys:     *flagMaxClientKeys,
+		MaxInflight:       *flagMaxInflight,
+		MaxKeyLength:      *flagMaxKeyLength,
+		MaxKeys:           *flagMaxKeys,
+		MaxMessage:        *flagMaxMessage,
+		ReadBuffer:        *flagReadBuffer,
+		ReadTimeout:       *flagReadTimeout,
+		SessionGrace:      *flagSessionGrace,
+		SnapshotInterval:  *flagSnapshotInterval,
+		TLSClientIdentity: *flagTLSClientId,
+		UnixGroup:         *flagUnixGroup,
+		WriteTimeout:      *flagWriteTimeout,
+	}
+	unixMode, err := strconv.ParseUint(*flagUnixMode, 8, 32)
+	if err != nil {
+		log.Fatalln("main: invalid -unix-mode:", err.Error())
+	}
+	options.UnixMode = os.FileMode(unixMode)
+	options.Fsync, err = server.ParseFsyncPolicy(*flagFsync)
+	if err != nil {
+		log.Fatalln("main: invalid -fsync:", err.Error())
+	}
+	if *flagKeyChars != "" {
+		options.KeyChars, err = server.ParseCharset(*flagKeyChars)
+		if err != nil {
+			log.Fatalln("main: invalid -key-chars:", err.Error())
+		}
+	}
+	if *flagTLSCert != "" || *flagTLSKey != "" {
+		options.TLS, err = server.LoadTLSConfig(*flagTLSCert, *flagTLSKey, *flagTLSClientCA)
+		if err != nil {
+			log.Fatalln("main: LoadTLSConfig:", err.Error())
+		}
+	} else if *flagTLSClientCA != "" || *flagTLSClientId {
+		log.Fatalln("-tls-client-ca and -tls-client-identity require -tls-cert and -tls-key.")
+	}
+	if *flagClusterSecret != "" {
+		secret, err := ioutil.ReadFile(*flagClusterSecret)
+		if err != nil {
+			log.Fatalln("main: read -cluster-secret-file:", err.Error())
+		}
+		options.ClusterSecret = strings.TrimSpace(string(secret))
+	}
+	if *flagTokensFile != "" {
+		options.Tokens, err = server.LoadTokens(*flagTokensFile)
+		if err != nil {
+			log.Fatalln("main: LoadTokens:", err.Error())
+		}
+	}
+	if *flagACLFile != "" {
+		options.ACL, err = server.LoadACL(*flagACLFile)
+		if err != nil {
+			log.Fatalln("main: LoadACL:", err.Error())
+		}
+	}
 
 	if *flagDebug {
 		log.SetFlags(log.Flags() | log.Lmicroseconds)
 	}
 
-	listenCount := server.Start()
+	srv := server.New(options)
+	listenCount := srv.Start()
 	if listenCount == 0 {
 		os.Exit(1)
 	}
@@ -48,11 +137,16 @@ func main() {
 	signal.Notify(sigIntChan, syscall.SIGINT)
 	go func() {
 		<-sigIntChan
-		if server.ConfigDebug {
+		if *flagDebug {
 			log.Printf("main: goroutines=%d", runtime.NumGoroutine())
 		}
-		server.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *flagShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("main: Server.Shutdown:", err.Error())
+			os.Exit(1)
+		}
 	}()
 
-	server.Wait()
+	srv.Wait()
 }
@@ -12,6 +12,14 @@ It has these top-level messages:
 	Request
 	Response
 	RequestLock
+	RequestSession
+	RequestWatch
+	RequestHello
+	RequestCancel
+	RequestList
+	LockInfo
+	Event
+	KeyHolders
 */
 package dlock
 
@@ -37,19 +45,40 @@ const (
 	RequestType_Ping    RequestType = 1
 	RequestType_Lock    RequestType = 2
 	RequestType_Unlock  RequestType = 3
+	RequestType_Extend  RequestType = 4
+	RequestType_Inspect RequestType = 5
+	RequestType_List    RequestType = 6
+	RequestType_Session RequestType = 7
+	RequestType_Watch   RequestType = 8
+	RequestType_Cancel  RequestType = 9
+	RequestType_Hello   RequestType = 10
 )
 
 var RequestType_name = map[int32]string{
-	0: "Invalid",
-	1: "Ping",
-	2: "Lock",
-	3: "Unlock",
+	0:  "Invalid",
+	1:  "Ping",
+	2:  "Lock",
+	3:  "Unlock",
+	4:  "Extend",
+	5:  "Inspect",
+	6:  "List",
+	7:  "Session",
+	8:  "Watch",
+	9:  "Cancel",
+	10: "Hello",
 }
 var RequestType_value = map[string]int32{
 	"Invalid": 0,
 	"Ping":    1,
 	"Lock":    2,
 	"Unlock":  3,
+	"Extend":  4,
+	"Inspect": 5,
+	"List":    6,
+	"Session": 7,
+	"Watch":   8,
+	"Cancel":  9,
+	"Hello":   10,
 }
 
 func (x RequestType) String() string {
@@ -64,13 +93,23 @@ const (
 	// 1-99: protocol level errors
 	// 100-119: [lock] input validation errors
 	// 120-139: [lock] response errors for valid input
-	ResponseStatus_Ok          ResponseStatus = 0
-	ResponseStatus_General     ResponseStatus = 1
-	ResponseStatus_Version     ResponseStatus = 2
-	ResponseStatus_InvalidType ResponseStatus = 3
+	ResponseStatus_Ok           ResponseStatus = 0
+	ResponseStatus_General      ResponseStatus = 1
+	ResponseStatus_Version      ResponseStatus = 2
+	ResponseStatus_InvalidType  ResponseStatus = 3
+	ResponseStatus_Unauthorized ResponseStatus = 4
+	ResponseStatus_Forbidden    ResponseStatus = 5
+	ResponseStatus_NotLeader    ResponseStatus = 6
 	// Lock 100-199
 	ResponseStatus_TooManyKeys    ResponseStatus = 100
+	ResponseStatus_KeyTooLong     ResponseStatus = 101
+	ResponseStatus_InvalidKey     ResponseStatus = 102
 	ResponseStatus_AcquireTimeout ResponseStatus = 120
+	ResponseStatus_NotLocked      ResponseStatus = 121
+	ResponseStatus_Deadlock       ResponseStatus = 122
+	ResponseStatus_SessionExpired ResponseStatus = 123
+	ResponseStatus_Cancelled      ResponseStatus = 124
+	ResponseStatus_TooManyHeld    ResponseStatus = 125
 )
 
 var ResponseStatus_name = map[int32]string{
@@ -78,16 +117,36 @@ var ResponseStatus_name = map[int32]string{
 	1:   "General",
 	2:   "Version",
 	3:   "InvalidType",
+	4:   "Unauthorized",
+	5:   "Forbidden",
+	6:   "NotLeader",
 	100: "TooManyKeys",
+	101: "KeyTooLong",
+	102: "InvalidKey",
 	120: "AcquireTimeout",
+	121: "NotLocked",
+	122: "Deadlock",
+	123: "SessionExpired",
+	124: "Cancelled",
+	125: "TooManyHeld",
 }
 var ResponseStatus_value = map[string]int32{
 	"Ok":             0,
 	"General":        1,
 	"Version":        2,
 	"InvalidType":    3,
+	"Unauthorized":   4,
+	"Forbidden":      5,
+	"NotLeader":      6,
 	"TooManyKeys":    100,
+	"KeyTooLong":     101,
+	"InvalidKey":     102,
 	"AcquireTimeout": 120,
+	"NotLocked":      121,
+	"Deadlock":       122,
+	"SessionExpired": 123,
+	"Cancelled":      124,
+	"TooManyHeld":    125,
 }
 
 func (x ResponseStatus) String() string {
@@ -95,13 +154,64 @@ func (x ResponseStatus) String() string {
 }
 func (ResponseStatus) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
+type LockMode int32
+
+const (
+	LockMode_Exclusive LockMode = 0
+	LockMode_Shared    LockMode = 1
+)
+
+var LockMode_name = map[int32]string{
+	0: "Exclusive",
+	1: "Shared",
+}
+var LockMode_value = map[string]int32{
+	"Exclusive": 0,
+	"Shared":    1,
+}
+
+func (x LockMode) String() string {
+	return proto.EnumName(LockMode_name, int32(x))
+}
+func (LockMode) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+type EventType int32
+
+const (
+	EventType_Acquire EventType = 0
+	EventType_Release EventType = 1
+	EventType_Expire  EventType = 2
+)
+
+var EventType_name = map[int32]string{
+	0: "Acquire",
+	1: "Release",
+	2: "Expire",
+}
+var EventType_value = map[string]int32{
+	"Acquire": 0,
+	"Release": 1,
+	"Expire":  2,
+}
+
+func (x EventType) String() string {
+	return proto.EnumName(EventType_name, int32(x))
+}
+func (EventType) EnumDescriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
 type Request struct {
 	Version     uint32      `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
 	Id          uint64      `protobuf:"varint,2,opt,name=id" json:"id,omitempty"`
 	AccessToken string      `protobuf:"bytes,3,opt,name=access_token,json=accessToken" json:"access_token,omitempty"`
 	Type        RequestType `protobuf:"varint,4,opt,name=type,enum=dlock.RequestType" json:"type,omitempty"`
 	// Ping is empty
-	Lock *RequestLock `protobuf:"bytes,51,opt,name=lock" json:"lock,omitempty"`
+	// Lock, Unlock, Extend, Inspect
+	Lock    *RequestLock    `protobuf:"bytes,51,opt,name=lock" json:"lock,omitempty"`
+	List    *RequestList    `protobuf:"bytes,52,opt,name=list" json:"list,omitempty"`
+	Session *RequestSession `protobuf:"bytes,53,opt,name=session" json:"session,omitempty"`
+	Watch   *RequestWatch   `protobuf:"bytes,54,opt,name=watch" json:"watch,omitempty"`
+	Cancel  *RequestCancel  `protobuf:"bytes,55,opt,name=cancel" json:"cancel,omitempty"`
+	Hello   *RequestHello   `protobuf:"bytes,56,opt,name=hello" json:"hello,omitempty"`
 }
 
 func (m *Request) Reset()                    { *m = Request{} }
@@ -144,13 +254,62 @@ func (m *Request) GetLock() *RequestLock {
 	return nil
 }
 
+func (m *Request) GetList() *RequestList {
+	if m != nil {
+		return m.List
+	}
+	return nil
+}
+
+func (m *Request) GetSession() *RequestSession {
+	if m != nil {
+		return m.Session
+	}
+	return nil
+}
+
+func (m *Request) GetWatch() *RequestWatch {
+	if m != nil {
+		return m.Watch
+	}
+	return nil
+}
+
+func (m *Request) GetCancel() *RequestCancel {
+	if m != nil {
+		return m.Cancel
+	}
+	return nil
+}
+
+func (m *Request) GetHello() *RequestHello {
+	if m != nil {
+		return m.Hello
+	}
+	return nil
+}
+
 type Response struct {
-	Version        uint32         `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
-	RequestId      uint64         `protobuf:"varint,2,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
-	Status         ResponseStatus `protobuf:"varint,3,opt,name=status,enum=dlock.ResponseStatus" json:"status,omitempty"`
-	ErrorText      string         `protobuf:"bytes,4,opt,name=error_text,json=errorText" json:"error_text,omitempty"`
-	Keys           []string       `protobuf:"bytes,5,rep,name=keys" json:"keys,omitempty"`
-	ServerUnixTime int64          `protobuf:"varint,6,opt,name=server_unix_time,json=serverUnixTime" json:"server_unix_time,omitempty"`
+	Version           uint32         `protobuf:"varint,1,opt,name=version" json:"version,omitempty"`
+	RequestId         uint64         `protobuf:"varint,2,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	Status            ResponseStatus `protobuf:"varint,3,opt,name=status,enum=dlock.ResponseStatus" json:"status,omitempty"`
+	ErrorText         string         `protobuf:"bytes,4,opt,name=error_text,json=errorText" json:"error_text,omitempty"`
+	Keys              []string       `protobuf:"bytes,5,rep,name=keys" json:"keys,omitempty"`
+	ServerUnixTime    int64          `protobuf:"varint,6,opt,name=server_unix_time,json=serverUnixTime" json:"server_unix_time,omitempty"`
+	FencingToken      uint64         `protobuf:"varint,7,opt,name=fencing_token,json=fencingToken" json:"fencing_token,omitempty"`
+	Holders           []*KeyHolders  `protobuf:"bytes,8,rep,name=holders" json:"holders,omitempty"`
+	Locks             []*LockInfo    `protobuf:"bytes,9,rep,name=locks" json:"locks,omitempty"`
+	Cursor            string         `protobuf:"bytes,10,opt,name=cursor" json:"cursor,omitempty"`
+	SessionId         string         `protobuf:"bytes,11,opt,name=session_id,json=sessionId" json:"session_id,omitempty"`
+	SessionGraceMicro uint64         `protobuf:"varint,12,opt,name=session_grace_micro,json=sessionGraceMicro" json:"session_grace_micro,omitempty"`
+	// Set only in messages pushed by server after Watch, which are not
+	// responses to any request. Other fields are empty then.
+	Event            *Event   `protobuf:"bytes,13,opt,name=event" json:"event,omitempty"`
+	Features         []string `protobuf:"bytes,14,rep,name=features" json:"features,omitempty"`
+	MaxMessage       uint32   `protobuf:"varint,15,opt,name=max_message,json=maxMessage" json:"max_message,omitempty"`
+	MaxKeys          uint32   `protobuf:"varint,16,opt,name=max_keys,json=maxKeys" json:"max_keys,omitempty"`
+	IdleTimeoutMicro uint64   `protobuf:"varint,17,opt,name=idle_timeout_micro,json=idleTimeoutMicro" json:"idle_timeout_micro,omitempty"`
+	Leader           string   `protobuf:"bytes,18,opt,name=leader" json:"leader,omitempty"`
 }
 
 func (m *Response) Reset()                    { *m = Response{} }
@@ -200,10 +359,97 @@ func (m *Response) GetServerUnixTime() int64 {
 	return 0
 }
 
+func (m *Response) GetFencingToken() uint64 {
+	if m != nil {
+		return m.FencingToken
+	}
+	return 0
+}
+
+func (m *Response) GetHolders() []*KeyHolders {
+	if m != nil {
+		return m.Holders
+	}
+	return nil
+}
+
+func (m *Response) GetLocks() []*LockInfo {
+	if m != nil {
+		return m.Locks
+	}
+	return nil
+}
+
+func (m *Response) GetCursor() string {
+	if m != nil {
+		return m.Cursor
+	}
+	return ""
+}
+
+func (m *Response) GetSessionId() string {
+	if m != nil {
+		return m.SessionId
+	}
+	return ""
+}
+
+func (m *Response) GetSessionGraceMicro() uint64 {
+	if m != nil {
+		return m.SessionGraceMicro
+	}
+	return 0
+}
+
+func (m *Response) GetEvent() *Event {
+	if m != nil {
+		return m.Event
+	}
+	return nil
+}
+
+func (m *Response) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+func (m *Response) GetMaxMessage() uint32 {
+	if m != nil {
+		return m.MaxMessage
+	}
+	return 0
+}
+
+func (m *Response) GetMaxKeys() uint32 {
+	if m != nil {
+		return m.MaxKeys
+	}
+	return 0
+}
+
+func (m *Response) GetIdleTimeoutMicro() uint64 {
+	if m != nil {
+		return m.IdleTimeoutMicro
+	}
+	return 0
+}
+
+func (m *Response) GetLeader() string {
+	if m != nil {
+		return m.Leader
+	}
+	return ""
+}
+
 type RequestLock struct {
 	WaitMicro    uint64   `protobuf:"varint,1,opt,name=wait_micro,json=waitMicro" json:"wait_micro,omitempty"`
 	ReleaseMicro uint64   `protobuf:"varint,2,opt,name=release_micro,json=releaseMicro" json:"release_micro,omitempty"`
 	Keys         []string `protobuf:"bytes,3,rep,name=keys" json:"keys,omitempty"`
+	Mode         LockMode `protobuf:"varint,4,opt,name=mode,enum=dlock.LockMode" json:"mode,omitempty"`
+	Limit        uint32   `protobuf:"varint,5,opt,name=limit" json:"limit,omitempty"`
+	Hierarchical bool     `protobuf:"varint,6,opt,name=hierarchical" json:"hierarchical,omitempty"`
 }
 
 func (m *RequestLock) Reset()                    { *m = RequestLock{} }
@@ -232,43 +478,420 @@ func (m *RequestLock) GetKeys() []string {
 	return nil
 }
 
+func (m *RequestLock) GetMode() LockMode {
+	if m != nil {
+		return m.Mode
+	}
+	return LockMode_Exclusive
+}
+
+func (m *RequestLock) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *RequestLock) GetHierarchical() bool {
+	if m != nil {
+		return m.Hierarchical
+	}
+	return false
+}
+
+type RequestSession struct {
+	Id         string `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	GraceMicro uint64 `protobuf:"varint,2,opt,name=grace_micro,json=graceMicro" json:"grace_micro,omitempty"`
+}
+
+func (m *RequestSession) Reset()                    { *m = RequestSession{} }
+func (m *RequestSession) String() string            { return proto.CompactTextString(m) }
+func (*RequestSession) ProtoMessage()               {}
+func (*RequestSession) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *RequestSession) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *RequestSession) GetGraceMicro() uint64 {
+	if m != nil {
+		return m.GraceMicro
+	}
+	return 0
+}
+
+type RequestWatch struct {
+	Keys   []string `protobuf:"bytes,1,rep,name=keys" json:"keys,omitempty"`
+	Prefix string   `protobuf:"bytes,2,opt,name=prefix" json:"prefix,omitempty"`
+}
+
+func (m *RequestWatch) Reset()                    { *m = RequestWatch{} }
+func (m *RequestWatch) String() string            { return proto.CompactTextString(m) }
+func (*RequestWatch) ProtoMessage()               {}
+func (*RequestWatch) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *RequestWatch) GetKeys() []string {
+	if m != nil {
+		return m.Keys
+	}
+	return nil
+}
+
+func (m *RequestWatch) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+type RequestHello struct {
+	Features       []string `protobuf:"bytes,1,rep,name=features" json:"features,omitempty"`
+	Name           string   `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	HeartbeatMicro uint64   `protobuf:"varint,3,opt,name=heartbeat_micro,json=heartbeatMicro" json:"heartbeat_micro,omitempty"`
+}
+
+func (m *RequestHello) Reset()                    { *m = RequestHello{} }
+func (m *RequestHello) String() string            { return proto.CompactTextString(m) }
+func (*RequestHello) ProtoMessage()               {}
+func (*RequestHello) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *RequestHello) GetFeatures() []string {
+	if m != nil {
+		return m.Features
+	}
+	return nil
+}
+
+func (m *RequestHello) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *RequestHello) GetHeartbeatMicro() uint64 {
+	if m != nil {
+		return m.HeartbeatMicro
+	}
+	return 0
+}
+
+type RequestCancel struct {
+	Id uint64 `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
+}
+
+func (m *RequestCancel) Reset()                    { *m = RequestCancel{} }
+func (m *RequestCancel) String() string            { return proto.CompactTextString(m) }
+func (*RequestCancel) ProtoMessage()               {}
+func (*RequestCancel) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *RequestCancel) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+type RequestList struct {
+	Prefix string `protobuf:"bytes,1,opt,name=prefix" json:"prefix,omitempty"`
+	Limit  uint32 `protobuf:"varint,2,opt,name=limit" json:"limit,omitempty"`
+	Cursor string `protobuf:"bytes,3,opt,name=cursor" json:"cursor,omitempty"`
+}
+
+func (m *RequestList) Reset()                    { *m = RequestList{} }
+func (m *RequestList) String() string            { return proto.CompactTextString(m) }
+func (*RequestList) ProtoMessage()               {}
+func (*RequestList) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *RequestList) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+func (m *RequestList) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *RequestList) GetCursor() string {
+	if m != nil {
+		return m.Cursor
+	}
+	return ""
+}
+
+type LockInfo struct {
+	Key          string   `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	ClientId     string   `protobuf:"bytes,2,opt,name=client_id,json=clientId" json:"client_id,omitempty"`
+	Created      int64    `protobuf:"varint,3,opt,name=created" json:"created,omitempty"`
+	Expires      int64    `protobuf:"varint,4,opt,name=expires" json:"expires,omitempty"`
+	Waiters      uint32   `protobuf:"varint,5,opt,name=waiters" json:"waiters,omitempty"`
+	Mode         LockMode `protobuf:"varint,6,opt,name=mode,enum=dlock.LockMode" json:"mode,omitempty"`
+	FencingToken uint64   `protobuf:"varint,7,opt,name=fencing_token,json=fencingToken" json:"fencing_token,omitempty"`
+	Identity     string   `protobuf:"bytes,8,opt,name=identity" json:"identity,omitempty"`
+	Limit        uint32   `protobuf:"varint,9,opt,name=limit" json:"limit,omitempty"`
+	Hierarchical bool     `protobuf:"varint,10,opt,name=hierarchical" json:"hierarchical,omitempty"`
+}
+
+func (m *LockInfo) Reset()                    { *m = LockInfo{} }
+func (m *LockInfo) String() string            { return proto.CompactTextString(m) }
+func (*LockInfo) ProtoMessage()               {}
+func (*LockInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *LockInfo) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *LockInfo) GetClientId() string {
+	if m != nil {
+		return m.ClientId
+	}
+	return ""
+}
+
+func (m *LockInfo) GetCreated() int64 {
+	if m != nil {
+		return m.Created
+	}
+	return 0
+}
+
+func (m *LockInfo) GetExpires() int64 {
+	if m != nil {
+		return m.Expires
+	}
+	return 0
+}
+
+func (m *LockInfo) GetWaiters() uint32 {
+	if m != nil {
+		return m.Waiters
+	}
+	return 0
+}
+
+func (m *LockInfo) GetMode() LockMode {
+	if m != nil {
+		return m.Mode
+	}
+	return LockMode_Exclusive
+}
+
+func (m *LockInfo) GetFencingToken() uint64 {
+	if m != nil {
+		return m.FencingToken
+	}
+	return 0
+}
+
+func (m *LockInfo) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *LockInfo) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *LockInfo) GetHierarchical() bool {
+	if m != nil {
+		return m.Hierarchical
+	}
+	return false
+}
+
+type Event struct {
+	Type         EventType `protobuf:"varint,1,opt,name=type,enum=dlock.EventType" json:"type,omitempty"`
+	Key          string    `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
+	ClientId     string    `protobuf:"bytes,3,opt,name=client_id,json=clientId" json:"client_id,omitempty"`
+	Time         int64     `protobuf:"varint,4,opt,name=time" json:"time,omitempty"`
+	Mode         LockMode  `protobuf:"varint,5,opt,name=mode,enum=dlock.LockMode" json:"mode,omitempty"`
+	FencingToken uint64    `protobuf:"varint,6,opt,name=fencing_token,json=fencingToken" json:"fencing_token,omitempty"`
+}
+
+func (m *Event) Reset()                    { *m = Event{} }
+func (m *Event) String() string            { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()               {}
+func (*Event) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *Event) GetType() EventType {
+	if m != nil {
+		return m.Type
+	}
+	return EventType_Acquire
+}
+
+func (m *Event) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Event) GetClientId() string {
+	if m != nil {
+		return m.ClientId
+	}
+	return ""
+}
+
+func (m *Event) GetTime() int64 {
+	if m != nil {
+		return m.Time
+	}
+	return 0
+}
+
+func (m *Event) GetMode() LockMode {
+	if m != nil {
+		return m.Mode
+	}
+	return LockMode_Exclusive
+}
+
+func (m *Event) GetFencingToken() uint64 {
+	if m != nil {
+		return m.FencingToken
+	}
+	return 0
+}
+
+type KeyHolders struct {
+	Key       string   `protobuf:"bytes,1,opt,name=key" json:"key,omitempty"`
+	ClientIds []string `protobuf:"bytes,2,rep,name=client_ids,json=clientIds" json:"client_ids,omitempty"`
+}
+
+func (m *KeyHolders) Reset()                    { *m = KeyHolders{} }
+func (m *KeyHolders) String() string            { return proto.CompactTextString(m) }
+func (*KeyHolders) ProtoMessage()               {}
+func (*KeyHolders) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *KeyHolders) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *KeyHolders) GetClientIds() []string {
+	if m != nil {
+		return m.ClientIds
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*Request)(nil), "dlock.Request")
 	proto.RegisterType((*Response)(nil), "dlock.Response")
 	proto.RegisterType((*RequestLock)(nil), "dlock.RequestLock")
+	proto.RegisterType((*RequestSession)(nil), "dlock.RequestSession")
+	proto.RegisterType((*RequestWatch)(nil), "dlock.RequestWatch")
+	proto.RegisterType((*RequestHello)(nil), "dlock.RequestHello")
+	proto.RegisterType((*RequestCancel)(nil), "dlock.RequestCancel")
+	proto.RegisterType((*RequestList)(nil), "dlock.RequestList")
+	proto.RegisterType((*LockInfo)(nil), "dlock.LockInfo")
+	proto.RegisterType((*Event)(nil), "dlock.Event")
+	proto.RegisterType((*KeyHolders)(nil), "dlock.KeyHolders")
 	proto.RegisterEnum("dlock.RequestType", RequestType_name, RequestType_value)
 	proto.RegisterEnum("dlock.ResponseStatus", ResponseStatus_name, ResponseStatus_value)
+	proto.RegisterEnum("dlock.LockMode", LockMode_name, LockMode_value)
+	proto.RegisterEnum("dlock.EventType", EventType_name, EventType_value)
 }
 
 func init() { proto.RegisterFile("dlock.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 428 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x7c, 0x92, 0xcf, 0x6e, 0xd4, 0x30,
-	0x10, 0xc6, 0xeb, 0x24, 0xcd, 0x36, 0x93, 0x36, 0x58, 0x96, 0x90, 0x72, 0x41, 0x0a, 0x8b, 0x84,
-	0xa2, 0x4a, 0xf4, 0xd0, 0xde, 0xb8, 0x71, 0x42, 0x15, 0x54, 0x20, 0x93, 0x72, 0x8d, 0x42, 0x32,
-	0x02, 0x2b, 0xbb, 0x76, 0x6a, 0x3b, 0x4b, 0xf2, 0x42, 0xbc, 0x0e, 0xaf, 0x84, 0xec, 0xa4, 0xcb,
-	0x9f, 0x03, 0x37, 0xcf, 0x6f, 0x26, 0xf3, 0x7d, 0xf3, 0x29, 0x90, 0x76, 0x3b, 0xd5, 0xf6, 0x57,
-	0x83, 0x56, 0x56, 0xb1, 0x53, 0x5f, 0x6c, 0x7f, 0x10, 0xd8, 0x70, 0x7c, 0x18, 0xd1, 0x58, 0x96,
-	0xc3, 0xe6, 0x80, 0xda, 0x08, 0x25, 0x73, 0x52, 0x90, 0xf2, 0x82, 0x3f, 0x96, 0x2c, 0x83, 0x40,
-	0x74, 0x79, 0x50, 0x90, 0x32, 0xe2, 0x81, 0xe8, 0xd8, 0x73, 0x38, 0x6f, 0xda, 0x16, 0x8d, 0xa9,
-	0xad, 0xea, 0x51, 0xe6, 0x61, 0x41, 0xca, 0x84, 0xa7, 0x0b, 0xab, 0x1c, 0x62, 0x2f, 0x21, 0xb2,
-	0xf3, 0x80, 0x79, 0x54, 0x90, 0x32, 0xbb, 0x66, 0x57, 0x8b, 0xf6, 0x2a, 0x55, 0xcd, 0x03, 0x72,
-	0xdf, 0x77, 0x73, 0xae, 0x93, 0xdf, 0x14, 0xa4, 0x4c, 0xff, 0x9d, 0x7b, 0xaf, 0xda, 0x9e, 0xfb,
-	0xfe, 0xf6, 0x27, 0x81, 0x33, 0x8e, 0x66, 0x50, 0xd2, 0xe0, 0x7f, 0x9c, 0x3e, 0x03, 0xd0, 0xcb,
-	0xb7, 0xf5, 0xd1, 0x71, 0xb2, 0x92, 0xdb, 0x8e, 0xbd, 0x82, 0xd8, 0xd8, 0xc6, 0x8e, 0xc6, 0x5b,
-	0xce, 0xae, 0x9f, 0x1e, 0xf5, 0x96, 0xcd, 0x9f, 0x7c, 0x93, 0xaf, 0x43, 0x6e, 0x1b, 0x6a, 0xad,
-	0x74, 0x6d, 0x71, 0xb2, 0xfe, 0x94, 0x84, 0x27, 0x9e, 0x54, 0x38, 0x59, 0xc6, 0x20, 0xea, 0x71,
-	0x36, 0xf9, 0x69, 0x11, 0x96, 0x09, 0xf7, 0x6f, 0x56, 0x02, 0x35, 0xa8, 0x0f, 0xa8, 0xeb, 0x51,
-	0x8a, 0xa9, 0xb6, 0x62, 0x8f, 0x79, 0x5c, 0x90, 0x32, 0xe4, 0xd9, 0xc2, 0xef, 0xa5, 0x98, 0x2a,
-	0xb1, 0xc7, 0x2d, 0x42, 0xfa, 0xc7, 0x99, 0x4e, 0xeb, 0x7b, 0x23, 0x6c, 0xbd, 0x17, 0xad, 0x56,
-	0xfe, 0xac, 0x88, 0x27, 0x8e, 0xdc, 0x39, 0xc0, 0x5e, 0xc0, 0x85, 0xc6, 0x1d, 0x36, 0x06, 0xd7,
-	0x89, 0xe5, 0xb6, 0xf3, 0x15, 0x2e, 0x43, 0x8f, 0x86, 0xc2, 0xdf, 0x86, 0x2e, 0x5f, 0x1f, 0x65,
-	0x5c, 0xea, 0x2c, 0x85, 0xcd, 0xad, 0x3c, 0x34, 0x3b, 0xd1, 0xd1, 0x13, 0x76, 0x06, 0xd1, 0x47,
-	0x21, 0xbf, 0x52, 0xe2, 0x5e, 0xce, 0x05, 0x0d, 0x18, 0x40, 0x7c, 0x2f, 0x5d, 0x28, 0x34, 0xbc,
-	0xfc, 0x06, 0xd9, 0xdf, 0xc9, 0xb0, 0x18, 0x82, 0x0f, 0x3d, 0x3d, 0x71, 0x6b, 0xde, 0xa2, 0x44,
-	0xdd, 0xec, 0x28, 0x71, 0xc5, 0xe7, 0x25, 0x7f, 0x1a, 0xb0, 0x27, 0x90, 0xae, 0x02, 0x4e, 0x8f,
-	0x86, 0x0e, 0x54, 0x4a, 0xdd, 0x35, 0x72, 0x7e, 0x87, 0xb3, 0xa1, 0x1d, 0x63, 0x90, 0xbd, 0x69,
-	0x1f, 0x46, 0xa1, 0xd1, 0xe5, 0xa0, 0x46, 0x4b, 0xa7, 0x2f, 0xb1, 0xff, 0x2b, 0x6f, 0x7e, 0x05,
-	0x00, 0x00, 0xff, 0xff, 0x54, 0xd0, 0x7e, 0x1d, 0xa4, 0x02, 0x00, 0x00,
+	// 1224 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x94, 0x56, 0xdd, 0x8e, 0xdb, 0x54,
+	0x10, 0xae, 0xe3, 0xc4, 0xb1, 0x27, 0xd9, 0xec, 0xe9, 0x69, 0xa9, 0x4c, 0x51, 0xd5, 0x90, 0x52,
+	0x08, 0x4b, 0x29, 0xa2, 0xe5, 0x4f, 0x48, 0x5c, 0x54, 0xb0, 0xb4, 0xab, 0x76, 0x01, 0x79, 0x53,
+	0xb8, 0x8c, 0x5c, 0x7b, 0x36, 0x39, 0x8a, 0x63, 0xa7, 0x3e, 0x27, 0xdb, 0xa4, 0xc0, 0x15, 0x57,
+	0x48, 0xbc, 0x07, 0xef, 0xc0, 0x35, 0x2f, 0xc4, 0x1b, 0xa0, 0x39, 0xe7, 0x38, 0x71, 0xca, 0xb2,
+	0x82, 0x3b, 0xcf, 0x7c, 0xe3, 0xc9, 0x37, 0xdf, 0xfc, 0x38, 0xd0, 0x49, 0xb3, 0x22, 0x99, 0xdd,
+	0x5d, 0x94, 0x85, 0x2a, 0x78, 0x4b, 0x1b, 0x83, 0x5f, 0x5c, 0x68, 0x47, 0xf8, 0x7c, 0x89, 0x52,
+	0xf1, 0x10, 0xda, 0x67, 0x58, 0x4a, 0x51, 0xe4, 0xa1, 0xd3, 0x77, 0x86, 0x7b, 0x51, 0x65, 0xf2,
+	0x1e, 0x34, 0x44, 0x1a, 0x36, 0xfa, 0xce, 0xb0, 0x19, 0x35, 0x44, 0xca, 0xdf, 0x84, 0x6e, 0x9c,
+	0x24, 0x28, 0xe5, 0x58, 0x15, 0x33, 0xcc, 0x43, 0xb7, 0xef, 0x0c, 0x83, 0xa8, 0x63, 0x7c, 0x23,
+	0x72, 0xf1, 0xb7, 0xa1, 0xa9, 0xd6, 0x0b, 0x0c, 0x9b, 0x7d, 0x67, 0xd8, 0xbb, 0xc7, 0xef, 0x9a,
+	0xdf, 0xb6, 0x3f, 0x35, 0x5a, 0x2f, 0x30, 0xd2, 0x38, 0xc5, 0x11, 0x12, 0xde, 0xef, 0x3b, 0xc3,
+	0xce, 0xab, 0x71, 0x4f, 0x8a, 0x64, 0x16, 0x69, 0x5c, 0xc7, 0x09, 0xa9, 0xc2, 0x8f, 0xce, 0x8d,
+	0x13, 0x52, 0x45, 0x1a, 0xe7, 0x1f, 0x40, 0x5b, 0xa2, 0xd4, 0x45, 0x7c, 0xac, 0x43, 0x5f, 0xdb,
+	0x0d, 0x3d, 0x31, 0x60, 0x54, 0x45, 0xf1, 0x77, 0xa1, 0xf5, 0x22, 0x56, 0xc9, 0x34, 0xfc, 0x44,
+	0x87, 0x5f, 0xd9, 0x0d, 0xff, 0x81, 0xa0, 0xc8, 0x44, 0xf0, 0x3b, 0xe0, 0x25, 0x71, 0x9e, 0x60,
+	0x16, 0x7e, 0xaa, 0x63, 0xaf, 0xee, 0xc6, 0x7e, 0xa9, 0xb1, 0xc8, 0xc6, 0x50, 0xe2, 0x29, 0x66,
+	0x59, 0x11, 0x7e, 0x76, 0x5e, 0xe2, 0x47, 0x04, 0x45, 0x26, 0x62, 0xf0, 0x57, 0x13, 0xfc, 0x08,
+	0xe5, 0xa2, 0xc8, 0x25, 0x5e, 0xd0, 0x86, 0x1b, 0x00, 0xa5, 0x79, 0x7b, 0xbc, 0x69, 0x47, 0x60,
+	0x3d, 0x47, 0x29, 0x7f, 0x1f, 0x3c, 0xa9, 0x62, 0xb5, 0x94, 0xba, 0x1f, 0xbd, 0x5a, 0xe5, 0x26,
+	0xf3, 0x89, 0x06, 0x23, 0x1b, 0x44, 0xd9, 0xb0, 0x2c, 0x8b, 0x72, 0xac, 0x70, 0xa5, 0x74, 0x9f,
+	0x82, 0x28, 0xd0, 0x9e, 0x11, 0xae, 0x14, 0xe7, 0xd0, 0x9c, 0xe1, 0x5a, 0x86, 0xad, 0xbe, 0x3b,
+	0x0c, 0x22, 0xfd, 0xcc, 0x87, 0xc0, 0x24, 0x96, 0x67, 0x58, 0x8e, 0x97, 0xb9, 0x58, 0x8d, 0x95,
+	0x98, 0x63, 0xe8, 0xf5, 0x9d, 0xa1, 0x1b, 0xf5, 0x8c, 0xff, 0x69, 0x2e, 0x56, 0x23, 0x31, 0x47,
+	0x7e, 0x0b, 0xf6, 0x4e, 0x31, 0x4f, 0x44, 0x3e, 0xb1, 0x23, 0xd2, 0xd6, 0x6c, 0xbb, 0xd6, 0x69,
+	0x66, 0xe4, 0x3d, 0x68, 0x4f, 0x8b, 0x2c, 0xc5, 0x52, 0x86, 0x7e, 0xdf, 0x1d, 0x76, 0xee, 0x5d,
+	0xb6, 0x8c, 0x1f, 0xe3, 0xfa, 0x91, 0x01, 0xa2, 0x2a, 0x82, 0xdf, 0x86, 0x16, 0x61, 0x32, 0x0c,
+	0x74, 0xe8, 0xbe, 0x0d, 0xa5, 0x11, 0x39, 0xca, 0x4f, 0x8b, 0xc8, 0xa0, 0xfc, 0x1a, 0x78, 0xc9,
+	0xb2, 0x94, 0x45, 0x19, 0x82, 0xae, 0xc8, 0x5a, 0x54, 0xad, 0xed, 0x38, 0x69, 0xd7, 0x31, 0xd5,
+	0x5a, 0xcf, 0x51, 0xca, 0xef, 0xc2, 0x95, 0x0a, 0x9e, 0x94, 0x71, 0x82, 0xe3, 0xb9, 0x48, 0xca,
+	0x22, 0xec, 0x6a, 0xd6, 0x97, 0x2d, 0xf4, 0x90, 0x90, 0x63, 0x02, 0xf8, 0x00, 0x5a, 0x78, 0x86,
+	0xb9, 0x0a, 0xf7, 0x74, 0x73, 0xbb, 0x96, 0xcd, 0x21, 0xf9, 0x22, 0x03, 0xf1, 0xeb, 0xe0, 0x9f,
+	0x62, 0xac, 0x96, 0x25, 0xca, 0xb0, 0xa7, 0x55, 0xdc, 0xd8, 0xfc, 0x26, 0x74, 0xe6, 0xf1, 0x6a,
+	0x3c, 0x47, 0x29, 0xe3, 0x09, 0x86, 0xfb, 0xba, 0xd1, 0x30, 0x8f, 0x57, 0xc7, 0xc6, 0xc3, 0x5f,
+	0x07, 0x9f, 0x02, 0x74, 0x0b, 0x98, 0x19, 0x83, 0x79, 0xbc, 0x7a, 0x4c, 0x5d, 0xb8, 0x03, 0x5c,
+	0xa4, 0x19, 0x6a, 0xf9, 0x8b, 0xa5, 0xb2, 0x54, 0x2f, 0x6b, 0xaa, 0x8c, 0x90, 0x91, 0x01, 0x0c,
+	0xd3, 0x6b, 0xe0, 0x65, 0x18, 0xa7, 0x58, 0x86, 0xdc, 0x08, 0x62, 0xac, 0xc1, 0x9f, 0x0e, 0x74,
+	0x6a, 0x6b, 0x46, 0x02, 0xbd, 0x88, 0x45, 0x95, 0xcd, 0x31, 0xc3, 0x45, 0x1e, 0x93, 0xe6, 0x16,
+	0xec, 0x95, 0x98, 0x61, 0x2c, 0x2b, 0x69, 0xcc, 0xf8, 0x75, 0xad, 0xd3, 0x04, 0x55, 0x33, 0xe3,
+	0xd6, 0x66, 0xe6, 0x16, 0x34, 0xe7, 0x45, 0x5a, 0x1d, 0x82, 0x7a, 0xdb, 0x8e, 0x8b, 0x14, 0x23,
+	0x0d, 0xf2, 0xab, 0xd0, 0xca, 0xc4, 0x5c, 0xa8, 0xb0, 0xa5, 0x4b, 0x35, 0x06, 0x1f, 0x40, 0x77,
+	0x2a, 0xb0, 0x8c, 0xcb, 0x64, 0x2a, 0x92, 0x38, 0xd3, 0xa3, 0xe6, 0x47, 0x3b, 0xbe, 0xc1, 0x03,
+	0xe8, 0xed, 0x6e, 0xb6, 0x3d, 0x56, 0x8e, 0x2e, 0x96, 0x8e, 0xd5, 0x4d, 0xe8, 0xd4, 0x5b, 0x6a,
+	0x78, 0xc3, 0x64, 0xd3, 0xcb, 0xc1, 0xe7, 0xd0, 0xad, 0x6f, 0xfb, 0xa6, 0x0a, 0xa7, 0x56, 0xc5,
+	0x35, 0xf0, 0x16, 0x25, 0x9e, 0x8a, 0x95, 0x7e, 0x3f, 0x88, 0xac, 0x35, 0x98, 0x40, 0xb7, 0xbe,
+	0xd0, 0x3b, 0x3d, 0x77, 0x5e, 0xe9, 0x39, 0x87, 0x66, 0x1e, 0xcf, 0xd1, 0x66, 0xd0, 0xcf, 0xfc,
+	0x1d, 0xd8, 0x9f, 0x62, 0x5c, 0xaa, 0x67, 0x18, 0x57, 0xd2, 0xbb, 0x9a, 0x60, 0x6f, 0xe3, 0x36,
+	0x24, 0x6f, 0xc2, 0xde, 0xce, 0x99, 0xa9, 0x95, 0xa9, 0x6f, 0xf2, 0xe0, 0x64, 0xdb, 0x4e, 0xba,
+	0x83, 0x5b, 0xc2, 0x4e, 0x9d, 0xf0, 0x56, 0xe9, 0x46, 0x5d, 0xe9, 0xed, 0xd6, 0xb8, 0xf5, 0xad,
+	0x19, 0xfc, 0xde, 0x00, 0xbf, 0xda, 0x30, 0xce, 0xc0, 0x9d, 0xe1, 0xda, 0xe6, 0xa3, 0x47, 0xfe,
+	0x06, 0x04, 0x49, 0x26, 0x30, 0xdf, 0xdc, 0xa3, 0x20, 0xf2, 0x8d, 0xe3, 0x28, 0xa5, 0x3b, 0x96,
+	0x94, 0x18, 0x2b, 0x4c, 0x75, 0x52, 0x37, 0xaa, 0x4c, 0x42, 0x70, 0xb5, 0x10, 0xa4, 0x51, 0xd3,
+	0x20, 0xd6, 0x24, 0x84, 0x46, 0x8e, 0x2e, 0x82, 0x99, 0x84, 0xca, 0xdc, 0x8c, 0x91, 0x77, 0xd1,
+	0x18, 0xfd, 0xa7, 0xab, 0x73, 0x1d, 0x7c, 0x91, 0x62, 0xae, 0x84, 0x5a, 0x87, 0xbe, 0xe1, 0x5c,
+	0xd9, 0x5b, 0x75, 0x82, 0x8b, 0xe6, 0x10, 0xce, 0x99, 0xc3, 0x3f, 0x1c, 0x68, 0xe9, 0xed, 0xe7,
+	0x6f, 0xd9, 0x2f, 0x9f, 0xa3, 0x99, 0xb2, 0xfa, 0x65, 0xa8, 0x7d, 0xf7, 0xac, 0x98, 0x8d, 0x7f,
+	0x11, 0xd3, 0x7d, 0x45, 0x4c, 0x0e, 0x4d, 0x7d, 0x6d, 0x8d, 0x5e, 0xfa, 0x79, 0x23, 0x49, 0xeb,
+	0x7f, 0x49, 0xe2, 0xfd, 0x53, 0x92, 0xc1, 0x17, 0x00, 0xdb, 0x93, 0x7b, 0x4e, 0x9f, 0x6f, 0x00,
+	0x6c, 0xa8, 0xc9, 0xb0, 0xa1, 0xe7, 0x3a, 0xa8, 0xb8, 0xc9, 0x83, 0xdf, 0xb6, 0xa7, 0x84, 0x2a,
+	0xe4, 0x1d, 0x68, 0x1f, 0xe5, 0x67, 0x71, 0x26, 0x52, 0x76, 0x89, 0xfb, 0xd0, 0xfc, 0x4e, 0xe4,
+	0x13, 0xe6, 0xd0, 0x13, 0x91, 0x63, 0x0d, 0x0e, 0xe0, 0x3d, 0xcd, 0x89, 0x2d, 0x73, 0xe9, 0xf9,
+	0x70, 0xa5, 0x30, 0x4f, 0x59, 0xd3, 0xbc, 0x28, 0x17, 0x98, 0x28, 0xd6, 0xd2, 0xe1, 0x42, 0x2a,
+	0xe6, 0x91, 0xdb, 0x2e, 0x37, 0x6b, 0xf3, 0x00, 0x5a, 0x7a, 0x4d, 0x99, 0x4f, 0xaf, 0x9a, 0x65,
+	0x60, 0x01, 0xb9, 0xf5, 0x06, 0x32, 0x38, 0xf8, 0xb5, 0x01, 0xbd, 0xdd, 0x6f, 0x1e, 0xf7, 0xa0,
+	0xf1, 0xed, 0x8c, 0x5d, 0xa2, 0x4c, 0x0f, 0x31, 0xc7, 0x32, 0xce, 0x98, 0x43, 0xc6, 0xf7, 0xe6,
+	0xcb, 0xca, 0x1a, 0x7c, 0x1f, 0x3a, 0x96, 0x33, 0x95, 0xc0, 0x5c, 0xce, 0xa0, 0xfb, 0x34, 0x8f,
+	0x97, 0x6a, 0x5a, 0x94, 0xe2, 0x25, 0x12, 0xbb, 0x3d, 0x08, 0xbe, 0x2e, 0xca, 0x67, 0x22, 0x4d,
+	0x31, 0x67, 0x2d, 0x32, 0xbf, 0x29, 0xd4, 0x13, 0x7d, 0x4d, 0x99, 0x47, 0x09, 0x46, 0x45, 0x71,
+	0x1c, 0xe7, 0x6b, 0x3a, 0xd2, 0x2c, 0xe5, 0x3d, 0x2d, 0xea, 0xa8, 0x28, 0x9e, 0x14, 0xf9, 0x84,
+	0x21, 0xd9, 0xf6, 0x17, 0x1e, 0xe3, 0x9a, 0x9d, 0x72, 0x0e, 0xbd, 0x07, 0xc9, 0xf3, 0xa5, 0x28,
+	0xab, 0x7b, 0xcd, 0x56, 0x55, 0xce, 0x22, 0x99, 0x61, 0xca, 0xd6, 0xbc, 0x0b, 0xfe, 0x57, 0x18,
+	0xeb, 0xbe, 0xb2, 0x97, 0xf4, 0x82, 0x95, 0xe1, 0x50, 0xaf, 0x4b, 0xca, 0x7e, 0xa4, 0x17, 0x8c,
+	0x04, 0x19, 0xa6, 0xec, 0xa7, 0x1a, 0x89, 0x47, 0x98, 0xa5, 0xec, 0xe7, 0x83, 0xdb, 0xe0, 0x57,
+	0x03, 0x41, 0xb1, 0x87, 0xab, 0x24, 0x5b, 0x4a, 0x71, 0x86, 0xec, 0x12, 0xa9, 0x77, 0x32, 0x8d,
+	0x29, 0x8d, 0x73, 0xf0, 0x21, 0x04, 0x9b, 0x01, 0x25, 0x5d, 0x2c, 0x31, 0xa3, 0x58, 0x64, 0x4e,
+	0x3c, 0x73, 0x4c, 0xaf, 0xe8, 0xa7, 0x59, 0xe3, 0x99, 0xa7, 0xff, 0x47, 0xde, 0xff, 0x7b, 0x00,
+	0x68, 0xe8, 0xff, 0xcc, 0x56, 0x0a, 0x00, 0x00,
 }
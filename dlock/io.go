@@ -15,7 +15,7 @@ var (
 
 func ReadMessage(r io.Reader, pb proto.Message, maxSize uint) error {
 	var sizeBytes [4]byte
-	_, err := r.Read(sizeBytes[:])
+	_, err := io.ReadFull(r, sizeBytes[:])
 	if err != nil {
 		return err
 	}
@@ -28,7 +28,7 @@ func ReadMessage(r io.Reader, pb proto.Message, maxSize uint) error {
 		return ErrorMessageTooLarge
 	}
 	buf := make([]byte, size)
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,12 @@
+package dlock
+
+// Protocol version implemented by this package.
+// Requests with zero version are treated as this one.
+const ProtocolVersion = 2
+
+// Protocol features negotiated by Hello request.
+const (
+	// Server handles requests concurrently and responds as soon as each
+	// one is done. Responses are matched to requests by id.
+	FeatureOutOfOrder = "out_of_order"
+)
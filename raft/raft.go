@@ -0,0 +1,803 @@
+// Package raft replicates log of commands among cluster nodes with Raft
+// consensus algorithm [1], so that all nodes apply the same commands in
+// the same order while majority of them is alive.
+//
+// Leader proposes commands it has already applied itself, others apply
+// them when committed. If leader loses leadership, its state machine is
+// restored from snapshot and committed entries, dropping uncommitted ones.
+//
+// [1] https://raft.github.io/raft.pdf
+package raft
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	Advertise       string // told to followers along with leadership, e.g. address of leader for clients
+	Bind            string // host:port of this node, one of Peers
+	Debug           bool
+	Dir             string        // for persistent state, required
+	ElectionTimeout time.Duration // default 1s, leader sends heartbeats 10 times as often
+	Peers           []string      // host:port of all nodes, including this one
+	Secret          string        // shared by all nodes, required, see handshake
+}
+
+// Commands are applied by one goroutine, one call at a time.
+type StateMachine interface {
+	// Applies committed command proposed by other node.
+	Apply(command []byte)
+	// Replaces state with result of applying commands to empty state.
+	Restore(commands [][]byte)
+	// Node has become leader and all previous commands are applied,
+	// or it is no longer leader. Restore follows the latter.
+	Lead(leading bool)
+}
+
+type entry struct {
+	Term    uint64
+	Command []byte // nil for entry which starts leadership
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+const maxBatch = 1000 // entries per AppendEntries
+
+var (
+	ErrorClosed    = errors.New("Closed")
+	ErrorNotLeader = errors.New("NotLeader")
+)
+
+type Node struct {
+	options Options
+	sm      StateMachine
+
+	// Persistent state.
+	log           []entry // after snapshot, log[i] has index snapshotIndex+1+i
+	logFile       *os.File
+	logSize       int64
+	offsets       []int64 // of log entries in logFile
+	snapshot      [][]byte
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	term          uint64
+	votedFor      string
+
+	// Volatile state.
+	closed      bool
+	commitIndex uint64
+	deadline    time.Time            // of election
+	epoch       uint64               // incremented when state machine is to be restored
+	heard       time.Time            // from leader, follower does not vote for others within ElectionTimeout
+	lastAck     map[string]time.Time // when request answered by peer was sent, see hasLease
+	lastApplied uint64
+	leader      string // Bind of current leader, empty if unknown
+	leaderAddr  string // Advertise of current leader
+	leading     bool   // state machine knows it leads, proposals are accepted
+	leadTerm    uint64 // in which state machine was told to lead
+	leaderSince time.Time
+	matchIndex  map[string]uint64
+	nextIndex   map[string]uint64
+	peers       map[string]*peer
+	rand        *rand.Rand // for election timeouts
+	restore     bool       // state machine must be restored from snapshot
+	role        role
+	startIndex  uint64 // first entry of current leadership
+	stepDown    bool   // state machine must be told it no longer leads
+	syncedIndex uint64 // written to disk with fsync
+	syncSignal  chan bool
+
+	cond     *sync.Cond        // on lk, broadcast on changes of commit, role and state machine
+	conns    map[net.Conn]bool // accepted from other nodes
+	listener net.Listener
+	lk       sync.Mutex
+	stop     chan bool
+	wg       sync.WaitGroup
+}
+
+// Creates node and reads its persistent state. Call Start or Serve to join cluster.
+func New(options Options, sm StateMachine) (*Node, error) {
+	if options.ElectionTimeout == 0 {
+		options.ElectionTimeout = time.Second
+	}
+	if options.Dir == "" {
+		return nil, errors.New("raft: Options.Dir is required")
+	}
+	// Any node may rewrite the log, so strangers must not pass for one.
+	if options.Secret == "" {
+		return nil, errors.New("raft: Options.Secret is required")
+	}
+	n := &Node{
+		options:    options,
+		sm:         sm,
+		conns:      make(map[net.Conn]bool),
+		lastAck:    make(map[string]time.Time),
+		matchIndex: make(map[string]uint64),
+		nextIndex:  make(map[string]uint64),
+		peers:      make(map[string]*peer),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		restore:    true,
+		syncSignal: make(chan bool, 1),
+		stop:       make(chan bool),
+	}
+	n.cond = sync.NewCond(&n.lk)
+	found := false
+	for _, address := range options.Peers {
+		if address == options.Bind {
+			found = true
+			continue
+		}
+		n.peers[address] = newPeer(address, options.Secret, options.ElectionTimeout/2)
+	}
+	if !found {
+		return nil, errors.New("raft: Options.Bind must be one of Options.Peers")
+	}
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Listens on Options.Bind for other nodes in background.
+func (n *Node) Start() error {
+	l, err := net.Listen("tcp", n.options.Bind)
+	if err != nil {
+		return err
+	}
+	go n.Serve(l)
+	return nil
+}
+
+// Serves other nodes on l and takes part in elections until closed.
+func (n *Node) Serve(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{n}); err != nil {
+		return err
+	}
+	n.lk.Lock()
+	if n.closed {
+		n.lk.Unlock()
+		l.Close()
+		return ErrorClosed
+	}
+	n.listener = l
+	n.resetDeadline()
+	n.wg.Add(3 + len(n.peers))
+	go n.tickLoop()
+	go n.applyLoop()
+	go n.syncLoop()
+	for _, p := range n.peers {
+		go n.replicateLoop(p)
+	}
+	n.lk.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if n.isClosed() {
+				return ErrorClosed
+			}
+			return err
+		}
+		n.lk.Lock()
+		if n.closed {
+			n.lk.Unlock()
+			conn.Close()
+			return ErrorClosed
+		}
+		n.conns[conn] = true
+		n.lk.Unlock()
+		go func() {
+			if err := handshake(conn, n.options.Secret, false, n.options.ElectionTimeout); err != nil {
+				log.Printf("Node.Serve: %s peer %s refused: %s", n.options.Bind, conn.RemoteAddr(), err.Error())
+			} else {
+				server.ServeConn(conn)
+			}
+			conn.Close()
+			n.lk.Lock()
+			delete(n.conns, conn)
+			n.lk.Unlock()
+		}()
+	}
+}
+
+// Stops taking part in cluster. State machine is not notified.
+func (n *Node) Close() {
+	n.lk.Lock()
+	if n.closed {
+		n.lk.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.stop)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.cond.Broadcast()
+	n.lk.Unlock()
+
+	n.wg.Wait()
+	for _, p := range n.peers {
+		p.close()
+	}
+	n.lk.Lock()
+	n.logFile.Close()
+	n.lk.Unlock()
+}
+
+func (n *Node) isClosed() bool {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.closed
+}
+
+// Appends commands to log, returns index of the last one. Caller must
+// have applied them already. Returns ErrorNotLeader unless state machine
+// has been told it leads in term, see LeaderTerm, so that commands applied
+// during past leadership, which Restore has undone, are not appended.
+func (n *Node) Propose(term uint64, commands ...[]byte) (uint64, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.closed {
+		return 0, ErrorClosed
+	}
+	if n.role != leader || !n.leading || n.term != term {
+		return 0, ErrorNotLeader
+	}
+	entries := make([]entry, len(commands))
+	for i, command := range commands {
+		entries[i] = entry{Term: term, Command: command}
+	}
+	if err := n.writeEntries(entries); err != nil {
+		return 0, err
+	}
+	n.signalSync()
+	n.signalPeers()
+	return n.lastIndex(), nil
+}
+
+// Term in which state machine was last told to lead, see Propose.
+func (n *Node) LeaderTerm() uint64 {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.leadTerm
+}
+
+// Index of the last proposed or received entry.
+func (n *Node) LastIndex() uint64 {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.lastIndex()
+}
+
+// Waits until entries up to index are committed. Returns ErrorNotLeader
+// if node is not leader or loses leadership meanwhile, then the entries
+// may or may not be committed.
+func (n *Node) Wait(index uint64) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	term := n.term
+	for n.commitIndex < index {
+		if n.closed {
+			return ErrorClosed
+		}
+		if n.role != leader || n.term != term {
+			return ErrorNotLeader
+		}
+		n.cond.Wait()
+	}
+	return nil
+}
+
+// Returns Options.Advertise of current leader, empty if unknown.
+func (n *Node) Leader() string {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.role == leader {
+		return n.options.Advertise
+	}
+	return n.leaderAddr
+}
+
+// Returns index of entries reflected in state machine. Unless stable,
+// leader has applied entries which are not committed yet, so its state
+// must not be used for snapshot.
+func (n *Node) Applied() (index uint64, stable bool) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	// State machine is about to be restored.
+	if n.stepDown || n.restore || (n.leading && n.role != leader) {
+		return n.lastApplied, false
+	}
+	if n.role != leader {
+		return n.lastApplied, true
+	}
+	// Entries of this leader were applied when proposed.
+	return n.lastIndex(), n.leading && n.commitIndex == n.lastIndex()
+}
+
+// Replaces log entries up to index with commands which recreate
+// state machine, see Applied.
+func (n *Node) Compact(index uint64, commands [][]byte) error {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.closed {
+		return ErrorClosed
+	}
+	if index <= n.snapshotIndex || index > n.lastIndex() {
+		return nil
+	}
+	n.snapshotTerm = n.termAt(index)
+	n.log = append([]entry(nil), n.log[index-n.snapshotIndex:]...)
+	n.snapshotIndex = index
+	n.snapshot = commands
+	if err := n.saveSnapshot(); err != nil {
+		return err
+	}
+	if n.options.Debug {
+		log.Printf("Node.Compact: index=%d commands=%d entries left=%d", index, len(commands), len(n.log))
+	}
+	return n.rewriteLog()
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.log))
+}
+
+// Term of entry at index, which must not be before snapshot.
+// This function must be called while holding n.lk lock.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm
+	}
+	return n.log[index-n.snapshotIndex-1].Term
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) majority() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) resetDeadline() {
+	timeout := n.options.ElectionTimeout
+	n.deadline = time.Now().Add(timeout + time.Duration(n.rand.Int63n(int64(timeout))))
+}
+
+// Adopts newer term or gives up leadership and candidacy.
+// This function must be called while holding n.lk lock.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		if err := n.saveState(); err != nil {
+			log.Printf("Node.becomeFollower: save state error: %s", err.Error())
+		}
+	}
+	if n.role == leader {
+		log.Printf("Node.becomeFollower: %s steps down in term %d", n.options.Bind, n.term)
+		n.stepDown = true
+	}
+	n.role = follower
+	n.resetDeadline()
+	n.cond.Broadcast()
+}
+
+// Checks election timeout, and whether leader still hears from majority.
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.lk.Lock()
+		now := time.Now()
+		switch {
+		case n.role != leader && now.After(n.deadline):
+			n.startElection()
+		case n.role == leader:
+			// Partitioned leader must not keep answering clients. New leader
+			// needs time to get first acks, as followers do.
+			if now.Sub(n.leaderSince) >= n.options.ElectionTimeout/2 && !n.hasLease(now) {
+				n.becomeFollower(n.term)
+				n.leader, n.leaderAddr = "", ""
+			}
+		}
+		n.lk.Unlock()
+	}
+}
+
+// Majority of nodes has answered requests sent by leader within half of
+// ElectionTimeout. Each of them refuses to vote for ElectionTimeout after
+// it received the request, so no other leader may be elected until this
+// lease runs out, with the other half to spare for clock drift.
+// This function must be called while holding n.lk lock.
+func (n *Node) hasLease(now time.Time) bool {
+	if n.role != leader {
+		return false
+	}
+	acks := 1
+	for address := range n.peers {
+		if now.Sub(n.lastAck[address]) < n.options.ElectionTimeout/2 {
+			acks++
+		}
+	}
+	return acks >= n.majority()
+}
+
+// Tells whether state machine leads and no other leader may have been
+// elected meanwhile. Leader must check it before answering clients from
+// state which is not committed through log, like locks bound to connection.
+func (n *Node) Lease() bool {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	return n.leading && n.hasLease(time.Now())
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.options.Bind
+	n.leader, n.leaderAddr = "", ""
+	n.resetDeadline()
+	if err := n.saveState(); err != nil {
+		log.Printf("Node.startElection: save state error: %s", err.Error())
+		return
+	}
+	if n.options.Debug {
+		log.Printf("Node.startElection: %s term=%d", n.options.Bind, n.term)
+	}
+	request := &VoteRequest{
+		Term:         n.term,
+		Candidate:    n.options.Bind,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeader()
+		return
+	}
+	for _, p := range n.peers {
+		go func(p *peer) {
+			response := &VoteResponse{}
+			if err := p.call("Raft.RequestVote", request, response); err != nil {
+				return
+			}
+			n.lk.Lock()
+			defer n.lk.Unlock()
+			if response.Term > n.term {
+				n.becomeFollower(response.Term)
+				return
+			}
+			if n.role != candidate || n.term != request.Term || !response.Granted {
+				return
+			}
+			if votes++; votes == n.majority() {
+				n.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+// Starts leadership with empty entry. State machine is told to lead
+// once it is committed, so all entries of previous terms are applied.
+// This function must be called while holding n.lk lock.
+func (n *Node) becomeLeader() {
+	log.Printf("Node.becomeLeader: %s term=%d", n.options.Bind, n.term)
+	n.role = leader
+	n.leader, n.leaderAddr = n.options.Bind, n.options.Advertise
+	n.leaderSince = time.Now()
+	for address := range n.peers {
+		n.nextIndex[address] = n.lastIndex() + 1
+		n.matchIndex[address] = 0
+		n.lastAck[address] = time.Time{}
+	}
+	if err := n.writeEntries([]entry{{Term: n.term}}); err != nil {
+		log.Printf("Node.becomeLeader: write error: %s", err.Error())
+		n.becomeFollower(n.term)
+		return
+	}
+	n.startIndex = n.lastIndex()
+	n.signalSync()
+	n.signalPeers()
+	n.cond.Broadcast()
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) signalPeers() {
+	for _, p := range n.peers {
+		select {
+		case p.signal <- true:
+		default:
+		}
+	}
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) signalSync() {
+	select {
+	case n.syncSignal <- true:
+	default:
+	}
+}
+
+// Flushes entries appended by leader to disk. Leader counts itself
+// in majority only for flushed entries.
+func (n *Node) syncLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.syncSignal:
+		}
+		n.lk.Lock()
+		file, index := n.logFile, n.lastIndex()
+		n.lk.Unlock()
+		if err := file.Sync(); err != nil {
+			log.Printf("Node.syncLoop: fsync error: %s", err.Error())
+			continue
+		}
+		n.lk.Lock()
+		if file == n.logFile && index > n.syncedIndex && index <= n.lastIndex() {
+			n.syncedIndex = index
+			n.advanceCommit()
+		}
+		n.lk.Unlock()
+	}
+}
+
+// Commits entries of current term stored by majority.
+// This function must be called while holding n.lk lock.
+func (n *Node) advanceCommit() {
+	if n.role != leader {
+		return
+	}
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.term; index-- {
+		count := 0
+		if n.syncedIndex >= index {
+			count++
+		}
+		for address := range n.peers {
+			if n.matchIndex[address] >= index {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = index
+			n.cond.Broadcast()
+			// Followers learn new commit index sooner than next heartbeat.
+			n.signalPeers()
+			return
+		}
+	}
+}
+
+// Sends entries or snapshot to peer when there are new ones,
+// and heartbeats while leader.
+func (n *Node) replicateLoop(p *peer) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.options.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-p.signal:
+		case <-ticker.C:
+		}
+		n.replicate(p)
+	}
+}
+
+func (n *Node) replicate(p *peer) {
+	n.lk.Lock()
+	if n.role != leader || n.closed {
+		n.lk.Unlock()
+		return
+	}
+	term := n.term
+	sent := time.Now()
+	next := n.nextIndex[p.address]
+	if next <= n.snapshotIndex {
+		request := &SnapshotRequest{
+			Term:      term,
+			Leader:    n.options.Bind,
+			Advertise: n.options.Advertise,
+			Index:     n.snapshotIndex,
+			IndexTerm: n.snapshotTerm,
+			Commands:  n.snapshot,
+		}
+		n.lk.Unlock()
+		response := &SnapshotResponse{}
+		if err := p.callTimeout("Raft.InstallSnapshot", request, response, 10*n.options.ElectionTimeout); err != nil {
+			return
+		}
+		n.lk.Lock()
+		defer n.lk.Unlock()
+		if response.Term > n.term {
+			n.becomeFollower(response.Term)
+			return
+		}
+		if n.role != leader || n.term != term {
+			return
+		}
+		n.ack(p, sent)
+		if request.Index > n.matchIndex[p.address] {
+			n.matchIndex[p.address] = request.Index
+		}
+		n.nextIndex[p.address] = n.matchIndex[p.address] + 1
+		n.signalPeer(p)
+		return
+	}
+
+	prev := next - 1
+	end := n.lastIndex()
+	if end-prev > maxBatch {
+		end = prev + maxBatch
+	}
+	request := &AppendRequest{
+		Term:      term,
+		Leader:    n.options.Bind,
+		Advertise: n.options.Advertise,
+		PrevIndex: prev,
+		PrevTerm:  n.termAt(prev),
+		Entries:   append([]entry(nil), n.log[prev-n.snapshotIndex:end-n.snapshotIndex]...),
+		Commit:    n.commitIndex,
+	}
+	n.lk.Unlock()
+	response := &AppendResponse{}
+	if err := p.call("Raft.AppendEntries", request, response); err != nil {
+		if n.options.Debug {
+			log.Printf("Node.replicate: %s error: %s", p.address, err.Error())
+		}
+		return
+	}
+
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if response.Term > n.term {
+		n.becomeFollower(response.Term)
+		return
+	}
+	if n.role != leader || n.term != term {
+		return
+	}
+	n.ack(p, sent)
+	if response.Success {
+		match := prev + uint64(len(request.Entries))
+		if match > n.matchIndex[p.address] {
+			n.matchIndex[p.address] = match
+		}
+		n.nextIndex[p.address] = n.matchIndex[p.address] + 1
+		n.advanceCommit()
+	} else {
+		// Follower tells where its log may match.
+		next = response.LastIndex + 1
+		if next > prev {
+			next = prev
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[p.address] = next
+	}
+	if n.nextIndex[p.address] <= n.lastIndex() {
+		n.signalPeer(p)
+	}
+}
+
+// Peer has answered request sent at time sent, see hasLease.
+// This function must be called while holding n.lk lock.
+func (n *Node) ack(p *peer, sent time.Time) {
+	if sent.After(n.lastAck[p.address]) {
+		n.lastAck[p.address] = sent
+	}
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) signalPeer(p *peer) {
+	select {
+	case p.signal <- true:
+	default:
+	}
+}
+
+// Feeds committed entries to state machine and tells it about
+// changes of leadership.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		n.lk.Lock()
+		for !n.closed && !n.stepDown && !n.restore && n.lastApplied >= n.commitIndex && !n.mayLead() {
+			n.cond.Wait()
+		}
+		if n.closed {
+			n.lk.Unlock()
+			return
+		}
+
+		if n.stepDown {
+			n.stepDown = false
+			n.restore = true
+			if n.leading {
+				n.leading = false
+				n.lk.Unlock()
+				n.sm.Lead(false)
+				continue
+			}
+		}
+		if n.restore {
+			n.restore = false
+			n.epoch++
+			n.lastApplied = n.snapshotIndex
+			commands := n.snapshot
+			n.lk.Unlock()
+			n.sm.Restore(commands)
+			continue
+		}
+		if n.mayLead() {
+			n.leading = true
+			n.leadTerm = n.term
+			n.cond.Broadcast()
+			n.lk.Unlock()
+			n.sm.Lead(true)
+			continue
+		}
+
+		epoch := n.epoch
+		first, last := n.lastApplied+1, n.commitIndex
+		// Entries proposed by this leader are applied already.
+		applyLast := last
+		if n.role == leader && applyLast >= n.startIndex {
+			applyLast = n.startIndex - 1
+		}
+		var entries []entry
+		if applyLast >= first {
+			entries = append(entries, n.log[first-n.snapshotIndex-1:applyLast-n.snapshotIndex]...)
+		}
+		n.lk.Unlock()
+
+		for _, e := range entries {
+			if e.Command != nil {
+				n.sm.Apply(e.Command)
+			}
+		}
+
+		n.lk.Lock()
+		if n.epoch == epoch && last > n.lastApplied {
+			n.lastApplied = last
+		}
+		n.cond.Broadcast()
+		n.lk.Unlock()
+	}
+}
+
+// Leader whose first entry is applied may tell state machine to lead.
+// This function must be called while holding n.lk lock.
+func (n *Node) mayLead() bool {
+	return n.role == leader && !n.leading && n.lastApplied >= n.startIndex
+}
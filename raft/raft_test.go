@@ -0,0 +1,265 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertNil(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Appends commands to list.
+type listMachine struct {
+	commands []string
+	leading  bool
+	lk       sync.Mutex
+}
+
+func (m *listMachine) Apply(command []byte) {
+	m.lk.Lock()
+	m.commands = append(m.commands, string(command))
+	m.lk.Unlock()
+}
+
+func (m *listMachine) Restore(commands [][]byte) {
+	m.lk.Lock()
+	m.commands = nil
+	for _, command := range commands {
+		m.commands = append(m.commands, string(command))
+	}
+	m.lk.Unlock()
+}
+
+func (m *listMachine) Lead(leading bool) {
+	m.lk.Lock()
+	m.leading = leading
+	m.lk.Unlock()
+}
+
+func (m *listMachine) String() string {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return strings.Join(m.commands, " ")
+}
+
+type testCluster struct {
+	dir      string
+	machines []*listMachine
+	nodes    []*Node
+	peers    []string
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	dir, err := ioutil.TempDir("", "raft")
+	assertNil(err)
+	c := &testCluster{dir: dir, machines: make([]*listMachine, size), nodes: make([]*Node, size)}
+	listeners := make([]net.Listener, size)
+	for i := range listeners {
+		listeners[i], err = net.Listen("tcp", "127.0.0.1:0")
+		assertNil(err)
+		c.peers = append(c.peers, listeners[i].Addr().String())
+	}
+	for i, l := range listeners {
+		c.start(i, l)
+	}
+	return c
+}
+
+func (c *testCluster) start(i int, l net.Listener) {
+	var err error
+	if l == nil {
+		l, err = net.Listen("tcp", c.peers[i])
+		assertNil(err)
+	}
+	c.machines[i] = &listMachine{}
+	c.nodes[i], err = New(Options{
+		Advertise:       fmt.Sprintf("client-%d", i),
+		Bind:            c.peers[i],
+		Dir:             filepath.Join(c.dir, fmt.Sprint(i)),
+		ElectionTimeout: 50 * time.Millisecond,
+		Peers:           c.peers,
+		Secret:          "test",
+	}, c.machines[i])
+	assertNil(err)
+	go c.nodes[i].Serve(l)
+}
+
+func (c *testCluster) close() {
+	for _, n := range c.nodes {
+		if n != nil {
+			n.Close()
+		}
+	}
+	os.RemoveAll(c.dir)
+}
+
+// Waits until state machine of some node leads.
+func (c *testCluster) leader(t *testing.T) int {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		for i, m := range c.machines {
+			m.lk.Lock()
+			leading := m.leading
+			m.lk.Unlock()
+			if leading && c.nodes[i] != nil {
+				return i
+			}
+		}
+	}
+	t.Fatal("No leader elected")
+	return -1
+}
+
+// Applies command on leader and proposes it, like users of package do.
+func (c *testCluster) propose(t *testing.T, i int, command string) {
+	c.machines[i].Apply([]byte(command))
+	index, err := c.nodes[i].Propose(c.nodes[i].LeaderTerm(), []byte(command))
+	assertNil(err)
+	assertNil(c.nodes[i].Wait(index))
+}
+
+func (c *testCluster) expect(t *testing.T, expected string) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		same := true
+		for i, m := range c.machines {
+			if c.nodes[i] != nil && m.String() != expected {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+	}
+	for i, m := range c.machines {
+		if c.nodes[i] != nil {
+			t.Errorf("Node %d state: '%s'", i, m.String())
+		}
+	}
+	t.Fatalf("Expected state: '%s'", expected)
+}
+
+func TestReplication(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	leader := c.leader(t)
+	follower := (leader + 1) % 3
+	if _, err := c.nodes[follower].Propose(c.nodes[leader].LeaderTerm(), []byte("x")); err != ErrorNotLeader {
+		t.Fatal("Follower Propose: expected ErrorNotLeader, got", err)
+	}
+	if c.nodes[follower].Leader() != fmt.Sprintf("client-%d", leader) {
+		t.Fatal("Follower knows wrong leader:", c.nodes[follower].Leader())
+	}
+	c.propose(t, leader, "a")
+	if _, err := c.nodes[leader].Propose(c.nodes[leader].LeaderTerm()-1, []byte("x")); err != ErrorNotLeader {
+		t.Fatal("Propose of past term: expected ErrorNotLeader, got", err)
+	}
+	c.propose(t, leader, "b")
+	c.expect(t, "a b")
+
+	// Remaining majority elects new leader, which has all committed entries.
+	c.nodes[leader].Close()
+	c.nodes[leader] = nil
+	leader2 := c.leader(t)
+	if leader2 == leader {
+		t.Fatal("Closed node is leader")
+	}
+	c.propose(t, leader2, "c")
+	c.expect(t, "a b c")
+
+	// Restarted node catches up from its log and the leader.
+	c.start(leader, nil)
+	c.propose(t, leader2, "d")
+	c.expect(t, "a b c d")
+}
+
+func TestSnapshot(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	leader := c.leader(t)
+	lagging := (leader + 1) % 3
+	c.nodes[lagging].Close()
+	c.nodes[lagging] = nil
+	for _, command := range []string{"a", "b", "c"} {
+		c.propose(t, leader, command)
+	}
+	index, stable := c.nodes[leader].Applied()
+	if !stable {
+		t.Fatal("Leader state is not stable after Wait")
+	}
+	assertNil(c.nodes[leader].Compact(index, [][]byte{[]byte("a"), []byte("b"), []byte("c")}))
+	c.propose(t, leader, "d")
+
+	// Lagging node gets snapshot, then new entries.
+	c.start(lagging, nil)
+	c.expect(t, "a b c d")
+
+	// Snapshot and log survive restart of leader too.
+	c.nodes[leader].Close()
+	c.start(leader, nil)
+	leader = c.leader(t)
+	c.propose(t, leader, "e")
+	c.expect(t, "a b c d e")
+}
+
+// Node without secret can not depose leader with higher term.
+func TestUnauthorizedPeer(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	leader := c.leader(t)
+	term := c.nodes[leader].LeaderTerm()
+	p := newPeer(c.peers[leader], "wrong", time.Second)
+	defer p.close()
+	err := p.call("Raft.AppendEntries", &AppendRequest{Term: term + 100, Leader: "stranger"}, &AppendResponse{})
+	if err != ErrorUnauthorized {
+		t.Fatal("AppendEntries with wrong secret: expected ErrorUnauthorized, got", err)
+	}
+	c.propose(t, leader, "a")
+	if c.nodes[leader].LeaderTerm() != term {
+		t.Fatal("Leader term changed by stranger:", term, c.nodes[leader].LeaderTerm())
+	}
+}
+
+// Followers which hear from leader refuse to elect another one, and leader
+// which does not hear from majority loses lease before they would.
+func TestLeaderLease(t *testing.T) {
+	c := newTestCluster(t, 3)
+	defer c.close()
+
+	leader := c.leader(t)
+	c.propose(t, leader, "a")
+	if !c.nodes[leader].Lease() {
+		t.Fatal("Leader has no lease after commit")
+	}
+	term := c.nodes[leader].LeaderTerm()
+	follower := (leader + 1) % len(c.nodes)
+	p := newPeer(c.peers[follower], "test", time.Second)
+	defer p.close()
+	response := &VoteResponse{}
+	assertNil(p.call("Raft.RequestVote", &VoteRequest{Term: term + 1, Candidate: "candidate", LastLogIndex: 100, LastLogTerm: term}, response))
+	if response.Granted || response.Term != term {
+		t.Fatal("Follower of live leader voted:", response.Granted, response.Term)
+	}
+
+	for i := range c.nodes {
+		if i != leader {
+			c.nodes[i].Close()
+			c.nodes[i] = nil
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	if c.nodes[leader].Lease() {
+		t.Fatal("Leader cut off from majority still has lease")
+	}
+}
@@ -0,0 +1,349 @@
+package raft
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Messages between nodes, exported for net/rpc.
+type VoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type VoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term      uint64
+	Leader    string
+	Advertise string
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []entry
+	Commit    uint64
+}
+
+type AppendResponse struct {
+	Term      uint64
+	Success   bool
+	LastIndex uint64 // on failure, entries after it may not match
+}
+
+type SnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	Advertise string
+	Index     uint64
+	IndexTerm uint64
+	Commands  [][]byte
+}
+
+type SnapshotResponse struct {
+	Term uint64
+}
+
+var (
+	ErrorTimeout      = errors.New("Timeout")
+	ErrorUnauthorized = errors.New("Unauthorized")
+)
+
+const nonceSize = 16
+
+// Connection to other node, dialed on demand.
+type peer struct {
+	address string
+	client  *rpc.Client
+	secret  string
+	signal  chan bool // to replicateLoop
+	timeout time.Duration
+	lk      sync.Mutex
+}
+
+func newPeer(address, secret string, timeout time.Duration) *peer {
+	return &peer{
+		address: address,
+		secret:  secret,
+		signal:  make(chan bool, 1),
+		timeout: timeout,
+	}
+}
+
+func (p *peer) call(method string, request, response interface{}) error {
+	return p.callTimeout(method, request, response, p.timeout)
+}
+
+// Broken or timed out connection is closed and dialed again by next call.
+func (p *peer) callTimeout(method string, request, response interface{}, timeout time.Duration) error {
+	p.lk.Lock()
+	client := p.client
+	if client == nil {
+		conn, err := net.DialTimeout("tcp", p.address, p.timeout)
+		if err == nil {
+			if err = handshake(conn, p.secret, true, p.timeout); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			p.lk.Unlock()
+			return err
+		}
+		client = rpc.NewClient(conn)
+		p.client = client
+	}
+	p.lk.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	call := client.Go(method, request, response, make(chan *rpc.Call, 1))
+	var err error
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-timer.C:
+		err = ErrorTimeout
+	}
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		p.lk.Lock()
+		if p.client == client {
+			p.client = nil
+		}
+		p.lk.Unlock()
+		client.Close()
+	}
+	return err
+}
+
+func (p *peer) close() {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	if p.client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// Proves to other end of conn that this node knows Options.Secret and
+// checks the same of it, without sending the secret. Each side signs
+// random nonce of the other along with its role, so that a proof can not
+// be replayed or reflected back. Nodes which fail are not served.
+func handshake(conn net.Conn, secret string, dialer bool, timeout time.Duration) error {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(nonce); err != nil {
+		return err
+	}
+	peerNonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(conn, peerNonce); err != nil {
+		return err
+	}
+	if _, err := conn.Write(handshakeProof(secret, dialer, peerNonce)); err != nil {
+		return err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return err
+	}
+	if !hmac.Equal(proof, handshakeProof(secret, !dialer, nonce)) {
+		return ErrorUnauthorized
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+func handshakeProof(secret string, dialer bool, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if dialer {
+		mac.Write([]byte("dialer"))
+	} else {
+		mac.Write([]byte("acceptor"))
+	}
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+type rpcService struct {
+	n *Node
+}
+
+func (s *rpcService) RequestVote(request *VoteRequest, response *VoteResponse) error {
+	n := s.n
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.closed {
+		return ErrorClosed
+	}
+	// Node which has heard from leader recently keeps it, so that leader
+	// may rely on its lease, see hasLease.
+	now := time.Now()
+	if request.Term > n.term && (n.hasLease(now) ||
+		(n.role == follower && n.leader != "" && now.Sub(n.heard) < n.options.ElectionTimeout)) {
+		response.Term = n.term
+		return nil
+	}
+	if request.Term > n.term {
+		n.becomeFollower(request.Term)
+	}
+	response.Term = n.term
+	if request.Term < n.term || (n.votedFor != "" && n.votedFor != request.Candidate) {
+		return nil
+	}
+	// Candidate log must be at least as up to date as ours.
+	lastTerm := n.termAt(n.lastIndex())
+	if request.LastLogTerm < lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex < n.lastIndex()) {
+		return nil
+	}
+	n.votedFor = request.Candidate
+	if err := n.saveState(); err != nil {
+		n.votedFor = ""
+		return err
+	}
+	n.resetDeadline()
+	response.Granted = true
+	if n.options.Debug {
+		log.Printf("Node.RequestVote: %s votes for %s in term %d", n.options.Bind, request.Candidate, n.term)
+	}
+	return nil
+}
+
+func (s *rpcService) AppendEntries(request *AppendRequest, response *AppendResponse) error {
+	n := s.n
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.closed {
+		return ErrorClosed
+	}
+	response.Term = n.term
+	if request.Term < n.term {
+		return nil
+	}
+	n.acceptLeader(request.Term, request.Leader, request.Advertise)
+	response.Term = n.term
+
+	if request.PrevIndex > n.lastIndex() {
+		response.LastIndex = n.lastIndex()
+		return nil
+	}
+	if request.PrevIndex > n.snapshotIndex && n.termAt(request.PrevIndex) != request.PrevTerm {
+		// Skip the whole conflicting term.
+		conflictTerm := n.termAt(request.PrevIndex)
+		index := request.PrevIndex
+		for index > n.snapshotIndex+1 && n.termAt(index-1) == conflictTerm {
+			index--
+		}
+		response.LastIndex = index - 1
+		return nil
+	}
+
+	var appended []entry
+	for i, e := range request.Entries {
+		index := request.PrevIndex + 1 + uint64(i)
+		if index <= n.snapshotIndex {
+			continue
+		}
+		if index <= n.lastIndex() {
+			if n.termAt(index) == e.Term {
+				continue
+			}
+			if err := n.truncateLog(index); err != nil {
+				return err
+			}
+		}
+		appended = request.Entries[i:]
+		break
+	}
+	if len(appended) > 0 {
+		if err := n.writeEntries(appended); err != nil {
+			return err
+		}
+		if err := n.logFile.Sync(); err != nil {
+			return err
+		}
+		n.syncedIndex = n.lastIndex()
+	}
+
+	last := request.PrevIndex + uint64(len(request.Entries))
+	if commit := request.Commit; commit > n.commitIndex {
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.cond.Broadcast()
+		}
+	}
+	response.Success = true
+	response.LastIndex = last
+	return nil
+}
+
+func (s *rpcService) InstallSnapshot(request *SnapshotRequest, response *SnapshotResponse) error {
+	n := s.n
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	if n.closed {
+		return ErrorClosed
+	}
+	response.Term = n.term
+	if request.Term < n.term {
+		return nil
+	}
+	n.acceptLeader(request.Term, request.Leader, request.Advertise)
+	response.Term = n.term
+	if request.Index <= n.snapshotIndex {
+		return nil
+	}
+
+	// Entries after snapshot are kept if they agree with it.
+	if request.Index < n.lastIndex() && n.termAt(request.Index) == request.IndexTerm {
+		n.log = append([]entry(nil), n.log[request.Index-n.snapshotIndex:]...)
+	} else {
+		n.log = nil
+	}
+	n.snapshotIndex, n.snapshotTerm, n.snapshot = request.Index, request.IndexTerm, request.Commands
+	if err := n.saveSnapshot(); err != nil {
+		return err
+	}
+	if err := n.rewriteLog(); err != nil {
+		return err
+	}
+	if n.commitIndex < n.snapshotIndex {
+		n.commitIndex = n.snapshotIndex
+	}
+	if n.lastApplied < n.snapshotIndex {
+		n.restore = true
+	}
+	n.cond.Broadcast()
+	log.Printf("Node.InstallSnapshot: %s index=%d from %s", n.options.Bind, request.Index, request.Leader)
+	return nil
+}
+
+// Follows leader of term, which may be newer than ours.
+// This function must be called while holding n.lk lock.
+func (n *Node) acceptLeader(term uint64, leader, advertise string) {
+	if term > n.term || n.role != follower {
+		n.becomeFollower(term)
+	}
+	n.resetDeadline()
+	n.heard = time.Now()
+	if n.leader != leader && n.options.Debug {
+		log.Printf("Node.acceptLeader: %s follows %s in term %d", n.options.Bind, leader, term)
+	}
+	n.leader, n.leaderAddr = leader, advertise
+}
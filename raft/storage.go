@@ -0,0 +1,276 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	logName      = "raft.log"
+	snapshotName = "raft.snapshot"
+	stateName    = "raft.state"
+
+	maxRecord = 64 << 20
+)
+
+// Term and vote must survive restart, or node could vote twice in one term.
+type persistentState struct {
+	Term     uint64
+	VotedFor string
+}
+
+type snapshotFile struct {
+	Index    uint64
+	Term     uint64
+	Commands [][]byte
+}
+
+// Reads persistent state, snapshot and log from options.Dir.
+// This function must be called before node is started.
+func (n *Node) load() error {
+	if err := os.MkdirAll(n.options.Dir, 0700); err != nil {
+		return err
+	}
+	var state persistentState
+	if err := readGob(filepath.Join(n.options.Dir, stateName), &state); err != nil {
+		return err
+	}
+	n.term, n.votedFor = state.Term, state.VotedFor
+
+	var snapshot snapshotFile
+	if err := readGob(filepath.Join(n.options.Dir, snapshotName), &snapshot); err != nil {
+		return err
+	}
+	n.snapshotIndex, n.snapshotTerm, n.snapshot = snapshot.Index, snapshot.Term, snapshot.Commands
+	n.commitIndex = n.snapshotIndex
+	n.lastApplied = n.snapshotIndex
+	return n.loadLog()
+}
+
+// Log file starts with index of its first entry, then each entry is
+// 4 bytes length, 8 bytes term and command. Incomplete entry at the end,
+// left by crash during write, is cut off.
+func (n *Node) loadLog() error {
+	path := filepath.Join(n.options.Dir, logName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return n.rewriteLog()
+	}
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var header [8]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		f.Close()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n.rewriteLog()
+		}
+		return err
+	}
+	first := binary.BigEndian.Uint64(header[:])
+	index := first
+	if index > n.snapshotIndex+1 {
+		f.Close()
+		return errors.New(fmt.Sprintf("%s starts at index %d, after snapshot index %d", path, index, n.snapshotIndex))
+	}
+	offset := int64(len(header))
+	for ; ; index++ {
+		e, size, err := readEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Node.loadLog: %s entry %d is incomplete, cut off", path, index)
+			break
+		}
+		if err != nil {
+			f.Close()
+			return errors.New(fmt.Sprintf("%s entry %d: %s", path, index, err.Error()))
+		}
+		if index > n.snapshotIndex {
+			n.log = append(n.log, e)
+			n.offsets = append(n.offsets, offset)
+		}
+		offset += size
+	}
+	f.Close()
+	// Snapshot was saved, but crash prevented replacing the log.
+	if first != n.snapshotIndex+1 {
+		return n.rewriteLog()
+	}
+
+	n.logFile, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	n.logSize = offset
+	n.syncedIndex = n.lastIndex()
+	return n.logFile.Truncate(offset)
+}
+
+func readEntry(r io.Reader) (entry, int64, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:4]); err != nil {
+		return entry{}, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size < 8 || size > maxRecord {
+		return entry{}, 0, errors.New(fmt.Sprintf("invalid entry size %d", size))
+	}
+	if _, err := io.ReadFull(r, header[4:]); err != nil {
+		return entry{}, 0, io.ErrUnexpectedEOF
+	}
+	e := entry{Term: binary.BigEndian.Uint64(header[4:])}
+	if size > 8 {
+		e.Command = make([]byte, size-8)
+		if _, err := io.ReadFull(r, e.Command); err != nil {
+			return entry{}, 0, io.ErrUnexpectedEOF
+		}
+	}
+	return e, int64(4 + size), nil
+}
+
+func encodeEntry(buf *bytes.Buffer, e entry) {
+	var header [12]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(8+len(e.Command)))
+	binary.BigEndian.PutUint64(header[4:], e.Term)
+	buf.Write(header[:])
+	buf.Write(e.Command)
+}
+
+// Writes entries to the end of log file, without fsync.
+// This function must be called while holding n.lk lock.
+func (n *Node) writeEntries(entries []entry) error {
+	var buf bytes.Buffer
+	offsets := make([]int64, len(entries))
+	for i, e := range entries {
+		offsets[i] = n.logSize + int64(buf.Len())
+		encodeEntry(&buf, e)
+	}
+	if _, err := n.logFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	n.log = append(n.log, entries...)
+	n.offsets = append(n.offsets, offsets...)
+	n.logSize += int64(buf.Len())
+	return nil
+}
+
+// Removes entries starting at index, which conflict with leader.
+// This function must be called while holding n.lk lock.
+func (n *Node) truncateLog(index uint64) error {
+	i := index - n.snapshotIndex - 1
+	offset := n.offsets[i]
+	if err := n.logFile.Truncate(offset); err != nil {
+		return err
+	}
+	n.log = n.log[:i]
+	n.offsets = n.offsets[:i]
+	n.logSize = offset
+	if n.syncedIndex > n.lastIndex() {
+		n.syncedIndex = n.lastIndex()
+	}
+	return nil
+}
+
+// Replaces log file with entries after snapshot.
+// This function must be called while holding n.lk lock.
+func (n *Node) rewriteLog() error {
+	var buf bytes.Buffer
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], n.snapshotIndex+1)
+	buf.Write(header[:])
+	offsets := make([]int64, len(n.log))
+	for i, e := range n.log {
+		offsets[i] = int64(buf.Len())
+		encodeEntry(&buf, e)
+	}
+	path := filepath.Join(n.options.Dir, logName)
+	if err := writeFileSync(path, buf.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+	n.logFile = file
+	n.offsets = offsets
+	n.logSize = int64(buf.Len())
+	n.syncedIndex = n.lastIndex()
+	return nil
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) saveState() error {
+	return writeGob(filepath.Join(n.options.Dir, stateName), &persistentState{Term: n.term, VotedFor: n.votedFor})
+}
+
+// This function must be called while holding n.lk lock.
+func (n *Node) saveSnapshot() error {
+	return writeGob(filepath.Join(n.options.Dir, snapshotName),
+		&snapshotFile{Index: n.snapshotIndex, Term: n.snapshotTerm, Commands: n.snapshot})
+}
+
+// Missing file leaves v as is.
+func readGob(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = gob.NewDecoder(bufio.NewReader(f)).Decode(v); err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+	}
+	return nil
+}
+
+func writeGob(path string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return writeFileSync(path, buf.Bytes())
+}
+
+// Atomically replaces file with data, durable after return.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	d, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"os"
+	"strings"
+)
+
+// Access rules: which identities may do what with which keys.
+// Nil ACL allows everything.
+type ACL struct {
+	rules []aclRule
+}
+
+type aclRule struct {
+	identity string   // * matches any
+	ops      []string // lowercase request type names, * matches any
+	globs    []string
+}
+
+// Reads ACL rules file. Each line is identity, comma separated operations
+// and one or more key globs, separated by whitespace. For example:
+//
+//	ci lock,unlock,extend,inspect ci/*
+//
+// Operations are request type names: lock, unlock, extend, inspect, list,
+// watch. Star matches any identity, any operation and any part of key,
+// including '/'. Empty lines and lines starting with # are skipped.
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACL{}
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected 'identity operations glob...'", path, lineno))
+		}
+		rule := aclRule{identity: fields[0], globs: fields[2:]}
+		for _, op := range strings.Split(fields[1], ",") {
+			op = strings.ToLower(op)
+			if _, ok := dlock.RequestType_value[strings.Title(op)]; !ok && op != "*" {
+				return nil, errors.New(fmt.Sprintf("%s:%d: unknown operation '%s'", path, lineno, op))
+			}
+			rule.ops = append(rule.ops, op)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, scanner.Err()
+}
+
+func (acl *ACL) Allowed(identity, op, key string) bool {
+	if acl == nil {
+		return true
+	}
+	for _, rule := range acl.rules {
+		if rule.identity != "*" && rule.identity != identity {
+			continue
+		}
+		if stringListFind(rule.ops, "*") == -1 && stringListFind(rule.ops, op) == -1 {
+			continue
+		}
+		for _, glob := range rule.globs {
+			if globMatch(glob, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns keys identity may not access with op.
+func (acl *ACL) Denied(identity, op string, keys []string) []string {
+	denied := make([]string, 0)
+	for _, key := range keys {
+		if !acl.Allowed(identity, op, key) {
+			denied = append(denied, key)
+		}
+	}
+	return denied
+}
+
+// Star matches any sequence of characters, other characters match themselves.
+func globMatch(glob, s string) bool {
+	star := strings.IndexByte(glob, '*')
+	if star == -1 {
+		return glob == s
+	}
+	if !strings.HasPrefix(s, glob[:star]) {
+		return false
+	}
+	rest := glob[star+1:]
+	for i := star; i <= len(s); i++ {
+		if globMatch(rest, s[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns keys of request which connection identity may not access.
+func (conn *Connection) deniedKeys(request *dlock.Request) []string {
+	if conn.server.options.ACL == nil {
+		return nil
+	}
+	op := strings.ToLower(request.GetType().String())
+	keys := make([]string, 0)
+	if request.Lock != nil {
+		keys = append(keys, request.Lock.Keys...)
+	}
+	if request.Watch != nil {
+		keys = append(keys, request.Watch.Keys...)
+	}
+	return conn.server.options.ACL.Denied(conn.identity, op, keys)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"os"
+	"strings"
+)
+
+var (
+	ErrorUnauthorized = errors.New("Unauthorized")
+)
+
+// Reads access tokens file. Each line is identity and token separated
+// by whitespace. Empty lines and lines starting with # are skipped.
+// Returns map from token to identity.
+func LoadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected 'identity token'", path, lineno))
+		}
+		if _, ok := tokens[fields[1]]; ok {
+			return nil, errors.New(fmt.Sprintf("%s:%d: duplicate token", path, lineno))
+		}
+		tokens[fields[1]] = fields[0]
+	}
+	return tokens, scanner.Err()
+}
+
+// Checks access token of request. First accepted token sets identity
+// of connection, later requests must have token of the same identity.
+func (conn *Connection) authorize(request *dlock.Request) error {
+	if conn.server.options.Tokens == nil {
+		return nil
+	}
+	identity, ok := conn.server.options.Tokens[request.GetAccessToken()]
+	if !ok || (conn.identity != "" && conn.identity != identity) {
+		return ErrorUnauthorized
+	}
+	if conn.identity == "" {
+		conn.identity = identity
+	}
+	return nil
+}
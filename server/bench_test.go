@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"github.com/temoto/dlock/dlock"
@@ -9,9 +9,9 @@ import (
 )
 
 func BenchmarkLockEmpty(b *testing.B) {
-	server := NewServer(":0", 1*time.Second)
+	server := New(Options{Bind: ":0", IdleTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second})
 	if n := server.Start(); n != 1 {
-		b.Fatal("NewServer: expected 1 listener, Server.Start():", n)
+		b.Fatal("New: expected 1 listener, Server.Start():", n)
 	}
 	conn1, err := net.Dial("tcp", server.listeners[0].Addr().String())
 	assertNil(err)
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/temoto/dlock/dlock"
+	"github.com/temoto/dlock/raft"
+	"log"
+	"strings"
+	"time"
+)
+
+// Lock table replicated among Options.Cluster nodes by raft. Leader serves
+// clients, followers answer their lock requests NotLeader with address of leader.
+// Replicated are locks which outlive connection: leases and locks of
+// sessions, also sessions with their grace deadlines and reserved fencing
+// tokens. Locks bound to connection without session and watches are not.
+type cluster struct {
+	closed   bool
+	fencing  uint64 // reserved fencing tokens
+	follower bool   // state machine does not lead, see Server.clusterLead
+	node     *raft.Node
+	stop     chan bool
+}
+
+// Command of cluster log. Each one sets state of a single record, so that
+// applying it again is harmless, see Server.clusterSnapshot.
+type clusterCommand struct {
+	Fencing uint64          // reserves fencing tokens up to it
+	Lock    *dlock.LockInfo // holder of key
+	Removed bool            // Lock is released or Session has expired
+	Session *clusterSession
+}
+
+type clusterSession struct {
+	Id       string
+	Identity string
+	Grace    time.Duration
+	Detached int64 // Unix nanoseconds when detached session expires, 0 while attached
+}
+
+// Keeps raft.StateMachine methods off Server API.
+type clusterMachine struct {
+	server *Server
+}
+
+var (
+	ErrorClusterDataDir = errors.New("Cluster requires DataDir for its log")
+	ErrorNotLeader      = errors.New("NotLeader")
+)
+
+func (m clusterMachine) Apply(command []byte)      { m.server.clusterApply(command) }
+func (m clusterMachine) Restore(commands [][]byte) { m.server.clusterRestore(commands) }
+func (m clusterMachine) Lead(leading bool)         { m.server.clusterLead(leading) }
+
+// Joins Options.Cluster as follower. Lock table is restored from cluster
+// log in Options.DataDir, then leader is elected among nodes.
+// Does nothing without Cluster or if it is already joined.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeOpenCluster() error {
+	if server.options.Cluster == "" || server.cluster != nil {
+		return nil
+	}
+	if server.options.DataDir == "" {
+		return ErrorClusterDataDir
+	}
+	c := &cluster{follower: true, stop: make(chan bool)}
+	node, err := raft.New(raft.Options{
+		Advertise:       server.options.ClusterAdvertise,
+		Bind:            server.options.ClusterBind,
+		Debug:           server.options.Debug,
+		Dir:             server.options.DataDir,
+		ElectionTimeout: server.options.ElectionTimeout,
+		Peers:           strings.Fields(server.options.Cluster),
+		Secret:          server.options.ClusterSecret,
+	}, clusterMachine{server})
+	if err != nil {
+		return err
+	}
+	// State machine is restored in background, once server.lk is released.
+	if err = node.Start(); err != nil {
+		node.Close()
+		return err
+	}
+	c.node = node
+	server.cluster = c
+	log.Printf("Server.openCluster: %s joins cluster %s, clients are redirected to %s",
+		server.options.ClusterBind, server.options.Cluster, server.options.ClusterAdvertise)
+	go server.clusterLoop(c)
+	return nil
+}
+
+// Leaves cluster. Server answers NotLeader after that.
+func (server *Server) closeCluster() {
+	server.lk.Lock()
+	c := server.cluster
+	if c == nil || c.closed {
+		server.lk.Unlock()
+		return
+	}
+	c.closed = true
+	c.follower = true
+	close(c.stop)
+	if server.commits != nil {
+		server.commits.close()
+		server.commits = nil
+	}
+	server.lk.Unlock()
+
+	// Node waits for state machine calls, which take server.lk.
+	c.node.Close()
+}
+
+// Makes snapshots in background until cluster is closed.
+func (server *Server) clusterLoop(c *cluster) {
+	ticker := time.NewTicker(server.options.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			server.clusterSnapshot(c)
+		}
+	}
+}
+
+// Replaces cluster log up to applied entries with commands which recreate
+// lock table. Follower may have applied a few more entries than it reports,
+// they are applied once more on top of snapshot with the same result.
+func (server *Server) clusterSnapshot(c *cluster) {
+	server.lk.Lock()
+	index, stable := c.node.Applied()
+	// Queued commands are applied, but not in log yet.
+	if server.commits != nil && !server.commits.idle() {
+		stable = false
+	}
+	if !stable {
+		server.lk.Unlock()
+		return
+	}
+	commands, err := server.unsafeClusterCommands()
+	server.lk.Unlock()
+	if err == nil {
+		err = c.node.Compact(index, commands)
+	}
+	if err != nil {
+		log.Printf("Server.clusterSnapshot: error: %s", err.Error())
+		return
+	}
+	if server.options.Debug {
+		log.Printf("Server.clusterSnapshot: index=%d commands=%d", index, len(commands))
+	}
+}
+
+// Returns commands which recreate replicated state.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeClusterCommands() ([][]byte, error) {
+	all := []*clusterCommand{{Fencing: server.cluster.fencing}}
+	for _, session := range server.sessions {
+		all = append(all, &clusterCommand{Session: session.clusterInfo()})
+	}
+	for key, ks := range server.keyLocks {
+		for _, kl := range ks.holders {
+			if server.unsafeReplicated(kl) {
+				all = append(all, &clusterCommand{Lock: kl.Info(key)})
+			}
+		}
+	}
+	commands := make([][]byte, len(all))
+	for i, command := range all {
+		var err error
+		if commands[i], err = encodeClusterCommand(command); err != nil {
+			return nil, err
+		}
+	}
+	return commands, nil
+}
+
+func encodeClusterCommand(command *clusterCommand) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(command); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (session *Session) clusterInfo() *clusterSession {
+	info := &clusterSession{Id: session.Id, Identity: session.Identity, Grace: session.Grace}
+	if !session.expires.IsZero() {
+		info.Detached = session.expires.UnixNano()
+	}
+	return info
+}
+
+// Requests which use lock table are served by leader. Follower answers
+// Hello and Ping itself, they don't depend on leader.
+func leaderRequest(request *dlock.Request) bool {
+	switch request.GetType() {
+	case dlock.RequestType_Lock, dlock.RequestType_Unlock, dlock.RequestType_Extend,
+		dlock.RequestType_Session, dlock.RequestType_Inspect, dlock.RequestType_List, dlock.RequestType_Watch:
+		return true
+	}
+	return false
+}
+
+// Cluster follower answers requests of leader with NotLeader, see leaderRequest.
+func (server *Server) isFollower() bool {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	return server.unsafeFollower()
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeFollower() bool {
+	return server.cluster != nil && server.cluster.follower
+}
+
+// Turns response into NotLeader, telling client where to go.
+func (server *Server) setNotLeader(response *dlock.Response) {
+	server.lk.Lock()
+	c := server.cluster
+	server.lk.Unlock()
+	response.Status = dlock.ResponseStatus_NotLeader
+	if c != nil {
+		response.Leader = c.node.Leader()
+	}
+	if response.Leader == "" {
+		response.ErrorText = "Server is not cluster leader, leader is unknown yet"
+	} else {
+		response.ErrorText = "Server is not cluster leader, connect to " + response.Leader
+	}
+}
+
+// Changes which cluster has not committed may be undone by new leader,
+// so client is told to retry with it, see commitResponse.
+func (server *Server) clusterResponse(response *dlock.Response) *dlock.Response {
+	switch response.GetStatus() {
+	case dlock.ResponseStatus_Version, dlock.ResponseStatus_Unauthorized, dlock.ResponseStatus_NotLeader:
+		return response
+	}
+	notLeader := &dlock.Response{
+		Version:        response.Version,
+		RequestId:      response.RequestId,
+		ServerUnixTime: response.ServerUnixTime,
+	}
+	server.setNotLeader(notLeader)
+	return notLeader
+}
+
+// Only these locks are replicated, others are bound to connection to leader.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReplicated(kl *KeyLock) bool {
+	return !kl.Expires.IsZero() || server.sessions[*kl.ClientId] != nil
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReplicateLock(key string, kl *KeyLock, removed bool) {
+	if server.unsafeReplicated(kl) {
+		server.unsafeReplicate(*kl.ClientId, &clusterCommand{Lock: kl.Info(key), Removed: removed})
+	}
+}
+
+// Reserves next block of fencing tokens, so that new leader continues
+// after tokens given out by this one.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReplicateFencing(clientId string) {
+	c := server.cluster
+	if server.fencing < c.fencing {
+		return
+	}
+	c.fencing = server.fencing + journalFencingBlock
+	server.unsafeReplicate(clientId, &clusterCommand{Fencing: c.fencing})
+}
+
+// Does nothing without cluster.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReplicateSession(session *Session, removed bool) {
+	if server.cluster != nil {
+		server.unsafeReplicate(session.Id, &clusterCommand{Session: session.clusterInfo(), Removed: removed})
+	}
+}
+
+// Queues command, which leader has already applied, for cluster log,
+// see clusterWriter. Follower changes nothing on its own, so it has
+// nothing to replicate.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReplicate(clientId string, command *clusterCommand) {
+	if server.cluster.follower || server.commits == nil {
+		return
+	}
+	data, err := encodeClusterCommand(command)
+	if err != nil {
+		log.Printf("Server.replicate: encode error: %s", err.Error())
+		return
+	}
+	server.unsafeCommit(clientId, data)
+}
+
+// Proposes queued commands to cluster log and waits until they are
+// committed, until leadership in term ends and q is closed.
+func (server *Server) clusterWriter(c *cluster, q *commitQueue, term uint64) {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.signal:
+		}
+		commands, last := q.take()
+		if len(commands) == 0 {
+			continue
+		}
+		index, err := c.node.Propose(term, commands...)
+		if err == nil {
+			err = c.node.Wait(index)
+		}
+		// Response fails too, see commitResponse.
+		if err != nil {
+			log.Printf("Server.clusterWriter: commands=%d error: %s", len(commands), err.Error())
+		}
+		q.done(last, err)
+	}
+}
+
+// Applies command of leader.
+func (server *Server) clusterApply(data []byte) {
+	command := &clusterCommand{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(command); err != nil {
+		log.Printf("Server.clusterApply: decode error: %s", err.Error())
+		return
+	}
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	server.unsafeClusterApply(command)
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeClusterApply(command *clusterCommand) {
+	c := server.cluster
+	if command.Fencing > c.fencing {
+		c.fencing = command.Fencing
+	}
+	// Leader may have given out all reserved tokens.
+	if c.fencing > server.fencing {
+		server.fencing = c.fencing
+	}
+
+	if s := command.Session; s != nil {
+		if command.Removed {
+			delete(server.sessions, s.Id)
+			server.unsafeReleaseClient(&s.Id)
+			return
+		}
+		session, ok := server.sessions[s.Id]
+		if !ok {
+			session = &Session{Id: s.Id, Grace: s.Grace, Identity: s.Identity}
+			server.sessions[s.Id] = session
+		}
+		session.expires = time.Time{}
+		if s.Detached != 0 {
+			session.expires = time.Unix(0, s.Detached)
+		}
+		if _, ok = server.clientLocks[s.Id]; !ok {
+			server.clientLocks[s.Id] = make([]string, 0, 1)
+		}
+	}
+
+	info := command.Lock
+	if info == nil {
+		return
+	}
+	if info.FencingToken > server.fencing {
+		server.fencing = info.FencingToken
+	}
+	ks := server.unsafeKeyState(info.Key)
+	var kl *KeyLock
+	for _, holder := range ks.holders {
+		if *holder.ClientId == info.ClientId {
+			kl = holder
+		}
+	}
+	if command.Removed {
+		if kl != nil {
+			server.unsafeDeleteKey(info.Key, kl, dlock.EventType_Release)
+		} else {
+			server.unsafeCleanKey(info.Key)
+		}
+		return
+	}
+
+	if kl == nil {
+		clientId := info.ClientId
+		created := time.Unix(0, info.Created)
+		kl = NewKeyLock(&clientId, &created, nil)
+		ks.holders = keyLockListPut(ks.holders, kl)
+	} else if kl.Hierarchical {
+		server.hierarchical--
+	}
+	kl.Expires = time.Time{}
+	if info.Expires != 0 {
+		kl.Expires = time.Unix(0, info.Expires)
+	}
+	kl.Identity = info.Identity
+	kl.Mode = info.Mode
+	kl.Limit = info.Limit
+	kl.Token = info.FencingToken
+	kl.Hierarchical = info.Hierarchical
+	if kl.Hierarchical {
+		server.hierarchical++
+	}
+	if clientLocks, ok := server.clientLocks[info.ClientId]; ok && stringListFind(clientLocks, info.Key) == -1 {
+		server.clientLocks[info.ClientId] = append(clientLocks, info.Key)
+	}
+}
+
+// Replaces lock table with state recreated by commands.
+// Clients connected to this server stay known, see initClientLocks.
+func (server *Server) clusterRestore(commands [][]byte) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	for key, ks := range server.keyLocks {
+		for _, kl := range ks.holders {
+			kl.stopExpireTimer()
+		}
+		// Index is scanned without server.lk, so it is not replaced.
+		server.keyIndex.Remove(key)
+	}
+	server.keyLocks = make(map[string]*KeyState)
+	server.hierarchical = 0
+	for _, session := range server.sessions {
+		session.stopTimer()
+	}
+	server.sessions = make(map[string]*Session)
+	clientLocks := make(map[string][]string)
+	for conn := range server.connections {
+		if _, ok := server.clientLocks[conn.clientId]; ok && conn.session == nil {
+			clientLocks[conn.clientId] = make([]string, 0, 1)
+		}
+	}
+	server.clientLocks = clientLocks
+	server.fencing = 0
+	server.cluster.fencing = 0
+
+	for _, data := range commands {
+		command := &clusterCommand{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(command); err != nil {
+			log.Printf("Server.clusterRestore: decode error: %s", err.Error())
+			continue
+		}
+		server.unsafeClusterApply(command)
+	}
+	if server.options.Debug {
+		log.Printf("Server.clusterRestore: commands=%d keys=%d sessions=%d",
+			len(commands), len(server.keyLocks), len(server.sessions))
+	}
+}
+
+// Leader starts timers of leases and detached sessions. Sessions which were
+// attached to previous leader are detached now, their clients have grace
+// period to reconnect here. Leader which steps down disconnects clients,
+// so that they look for new leader; its changes which may be uncommitted
+// are undone by Restore, which follows.
+func (server *Server) clusterLead(leading bool) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	c := server.cluster
+	now := time.Now()
+
+	if !leading {
+		log.Printf("Server.clusterLead: %s is no longer leader", server.options.ClusterBind)
+		c.follower = true
+		if server.commits != nil {
+			server.commits.close()
+			server.commits = nil
+		}
+		for conn := range server.connections {
+			conn.funClose()
+		}
+		for clientId := range server.clientWaiters {
+			server.unsafeAbortWaiters(clientId)
+		}
+		for _, ks := range server.keyLocks {
+			for _, kl := range ks.holders {
+				kl.stopExpireTimer()
+			}
+		}
+		for _, session := range server.sessions {
+			session.stopTimer()
+		}
+		return
+	}
+
+	if c.closed {
+		return
+	}
+	c.follower = false
+	// Sequence numbers start over with new queue.
+	server.commits = newCommitQueue()
+	server.clientCommits = make(map[string]uint64)
+	go server.clusterWriter(c, server.commits, c.node.LeaderTerm())
+	for key, ks := range server.keyLocks {
+		for _, kl := range ks.holders {
+			server.unsafeStartExpireTimer(key, kl, &now)
+		}
+	}
+	for _, session := range server.sessions {
+		if session.conn != nil {
+			continue
+		}
+		if session.expires.IsZero() {
+			session.expires = now.Add(session.Grace)
+			server.unsafeReplicateSession(session, false)
+		}
+		server.unsafeStartSessionTimer(session, &now)
+	}
+	log.Printf("Server.clusterLead: %s leads cluster, keys=%d sessions=%d fencing=%d",
+		server.options.ClusterBind, len(server.keyLocks), len(server.sessions), server.fencing)
+}
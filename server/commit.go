@@ -0,0 +1,176 @@
+package server
+
+import (
+	"errors"
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"sync"
+)
+
+// Records of lock table changes on their way to journal or cluster log.
+// Records are queued in order of changes while holding server.lk, and
+// written by journalLoop or clusterWriter without it, so that lock traffic
+// does not wait for disk. Response to client waits until its last change
+// is written, see Server.commitResponse.
+type commitQueue struct {
+	closed  bool
+	cond    *sync.Cond // on lk, broadcast when written advances or queue is closed
+	failed  uint64     // last record which could not be written
+	lk      sync.Mutex
+	queued  uint64   // sequence number of last queued record
+	records [][]byte // queued, not taken by writer yet
+	signal  chan bool
+	stop    chan bool // closed by close
+	written uint64    // sequence number of last written record
+}
+
+var (
+	ErrorCommitClosed = errors.New("CommitClosed")
+	ErrorCommitFailed = errors.New("CommitFailed")
+)
+
+func newCommitQueue() *commitQueue {
+	q := &commitQueue{signal: make(chan bool, 1), stop: make(chan bool)}
+	q.cond = sync.NewCond(&q.lk)
+	return q
+}
+
+// Returns sequence number of queued record.
+func (q *commitQueue) put(record []byte) uint64 {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	q.records = append(q.records, record)
+	q.queued++
+	select {
+	case q.signal <- true:
+	default:
+	}
+	return q.queued
+}
+
+// Returns queued records and sequence number of the last one.
+func (q *commitQueue) take() ([][]byte, uint64) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	records := q.records
+	q.records = nil
+	return records, q.queued
+}
+
+// Tells waiters that records up to last are written, or failed with err.
+func (q *commitQueue) done(last uint64, err error) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if err != nil {
+		q.failed = last
+	}
+	if last > q.written {
+		q.written = last
+	}
+	q.cond.Broadcast()
+}
+
+// Waits until record seq is written. Error means it may be lost.
+// Failure of later records is reported for earlier ones too,
+// if it happens before waiter wakes up.
+func (q *commitQueue) wait(seq uint64) error {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	for q.written < seq && !q.closed {
+		q.cond.Wait()
+	}
+	if q.written < seq {
+		return ErrorCommitClosed
+	}
+	if seq <= q.failed {
+		return ErrorCommitFailed
+	}
+	return nil
+}
+
+// Last written record.
+func (q *commitQueue) last() uint64 {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.written
+}
+
+// All queued records are written.
+func (q *commitQueue) idle() bool {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.written == q.queued
+}
+
+// Fails records which are still queued and wakes all waiters.
+func (q *commitQueue) close() {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.records = nil
+	close(q.stop)
+	q.cond.Broadcast()
+}
+
+// Queues record of change made on behalf of client.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeCommit(clientId string, record []byte) {
+	server.clientCommits[clientId] = server.commits.put(record)
+}
+
+// Forgets last changes of clients which are written already.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafePruneCommits() {
+	written := server.commits.last()
+	for clientId, seq := range server.clientCommits {
+		if seq <= written {
+			delete(server.clientCommits, clientId)
+		}
+	}
+}
+
+// Changes must be written before client is told about them. Responses
+// to clients without changes in flight are not delayed. If changes may be
+// lost, client gets General status instead, or NotLeader in cluster.
+func (server *Server) commitResponse(conn *Connection, response *dlock.Response) *dlock.Response {
+	server.lk.Lock()
+	q, seq := server.commits, server.clientCommits[conn.clientId]
+	c := server.cluster
+	leading := c != nil && !c.follower
+	server.lk.Unlock()
+	var err error
+	if q != nil && seq != 0 {
+		err = q.wait(seq)
+		server.lk.Lock()
+		if server.commits == q && server.clientCommits[conn.clientId] == seq {
+			delete(server.clientCommits, conn.clientId)
+		}
+		server.lk.Unlock()
+	}
+	// Leader cut off from majority may have been replaced by now, and new
+	// leader may have granted the same keys, see raft.Node.Lease.
+	if err == nil && leading && !c.node.Lease() {
+		err = ErrorNotLeader
+	}
+	if err == nil {
+		return response
+	}
+	log.Printf("Server.commitResponse: %s request %d: %s", conn.remoteAddr, response.GetRequestId(), err.Error())
+	if c != nil {
+		return server.clusterResponse(response)
+	}
+	switch response.GetStatus() {
+	case dlock.ResponseStatus_Version, dlock.ResponseStatus_Unauthorized:
+		return response
+	}
+	return &dlock.Response{
+		Version:        response.Version,
+		RequestId:      response.RequestId,
+		ServerUnixTime: response.ServerUnixTime,
+		Status:         dlock.ResponseStatus_General,
+		ErrorText:      "Change could not be written to journal: " + err.Error(),
+	}
+}
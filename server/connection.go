@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bufio"
+	"github.com/temoto/dlock/dlock"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Connection struct {
+	LastRequestTime time.Time
+	Rch             chan *dlock.Request
+	Wch             chan *dlock.Response
+
+	clientId     string
+	events       []*dlock.Response // pushed by server, protected by lk
+	eventSignal  chan bool
+	handlers     map[dlock.RequestType]HandlerFunc
+	identity     string         // from access token
+	idleTimeout  time.Duration  // protected by lk, see handleHello
+	inflight     chan bool      // limits concurrent handlers
+	inflightWait sync.WaitGroup // of concurrent handlers
+	ioWait       sync.WaitGroup
+	keyOrder     map[string]chan bool // closed when last handler in flight on key is done, protected by lk
+	messageCount uint64
+	name         string                     // of client program, from Hello
+	outOfOrder   bool                       // handlers run concurrently, see handleHello
+	pending      map[uint64]*pendingRequest // by request id, protected by lk
+	r            *bufio.Reader
+	remoteAddr   string
+	server       *Server
+	session      *Session // protected by server.lk
+	w            *bufio.Writer
+	lk           sync.Mutex
+
+	funClose             func() error
+	funHandshake         func() error // nil for plain connection
+	funResetIdleTimeout  func() error
+	funResetReadTimeout  func() error
+	funResetWriteTimeout func() error
+}
+
+// Request read from connection and not yet answered.
+type pendingRequest struct {
+	cancel  chan bool // closed by Cancel request
+	request *dlock.Request
+}
+
+func NewConnection(server *Server, clientId string) *Connection {
+	return &Connection{
+		Rch: make(chan *dlock.Request, 1),
+		Wch: make(chan *dlock.Response, 1),
+
+		clientId:    clientId,
+		eventSignal: make(chan bool, 1),
+		idleTimeout: server.options.IdleTimeout,
+		inflight:    make(chan bool, server.options.MaxInflight),
+		keyOrder:    make(map[string]chan bool),
+		pending:     make(map[uint64]*pendingRequest),
+		remoteAddr:  clientId,
+		server:      server,
+	}
+}
+
+func (conn *Connection) Wait() {
+	conn.ioWait.Wait()
+}
+
+func (conn *Connection) keyLock() *KeyLock {
+	now := time.Now()
+	kl := NewKeyLock(&conn.clientId, &now, nil)
+	kl.Identity = conn.identity
+	return kl
+}
+
+func (conn *Connection) loop() {
+	defer conn.server.wg.Done()
+	defer conn.server.removeConnection(conn)
+	defer conn.server.releaseConnection(conn)
+	defer conn.funClose()
+
+	if conn.funHandshake != nil {
+		if err := conn.funHandshake(); err != nil {
+			log.Printf("Connection.loop: %s handshake error: %s", conn.remoteAddr, err.Error())
+			return
+		}
+	}
+
+	conn.ioWait.Add(2)
+	go conn.readLoop()
+	go conn.writeLoop()
+
+	for request := range conn.Rch {
+		conn.LastRequestTime = time.Now()
+		handler, ok := conn.handlers[request.GetType()]
+		if !ok {
+			handler = handleUnknown
+		}
+		if v := request.GetVersion(); v != 0 && v != dlock.ProtocolVersion {
+			handler = handleVersion
+		} else if conn.authorize(request) != nil {
+			handler = handleUnauthorized
+		} else if !conn.isPending(request) {
+			handler = handleDuplicate
+		} else if leaderRequest(request) && conn.server.isFollower() {
+			handler = handleNotLeader
+		} else if len(conn.deniedKeys(request)) > 0 {
+			handler = handleForbidden
+		}
+
+		// Hello and Session change connection state, so they wait
+		// for handlers in flight and run alone. Requests sharing keys,
+		// like Lock and Unlock of the same key, run in order of arrival.
+		switch request.GetType() {
+		case dlock.RequestType_Hello, dlock.RequestType_Session:
+			conn.inflightWait.Wait()
+		default:
+			if conn.outOfOrder {
+				conn.inflight <- true
+				conn.inflightWait.Add(1)
+				done := make(chan bool)
+				after := conn.orderKeys(request, done)
+				go func(handler HandlerFunc, request *dlock.Request) {
+					defer conn.inflightWait.Done()
+					for _, ch := range after {
+						<-ch
+					}
+					conn.handle(handler, request)
+					conn.finishKeys(request, done)
+					<-conn.inflight
+				}(handler, request)
+				continue
+			}
+		}
+		conn.handle(handler, request)
+	}
+	conn.inflightWait.Wait()
+	close(conn.Wch)
+
+	conn.ioWait.Wait()
+}
+
+func (conn *Connection) handle(handler HandlerFunc, request *dlock.Request) {
+	defer conn.server.profileTime("Connection.loop: handler", time.Now())
+	handler(conn, request)
+	conn.finishPending(request)
+}
+
+func (conn *Connection) readLoop() {
+	defer conn.server.releaseConnection(conn)
+	defer conn.ioWait.Done()
+	defer close(conn.Rch)
+
+	var err error
+	for {
+		conn.messageCount++
+
+		conn.funResetIdleTimeout()
+		_, err = conn.r.Peek(4)
+		if err != nil {
+			log.Printf("Connection.readLoop: %s #%d peek error: %s",
+				conn.remoteAddr, conn.messageCount, err.Error())
+			return
+		}
+
+		request := &dlock.Request{}
+		conn.funResetReadTimeout()
+		err = dlock.ReadMessage(conn.r, request, conn.server.options.MaxMessage)
+
+		if err == nil && request.Lock != nil && len(request.Lock.Keys) > 1 {
+			sort.Strings(request.Lock.Keys)
+		}
+		if err != nil {
+			// On EOF, close silently.
+			if err == io.EOF {
+				return
+			}
+			log.Printf("Connection.readLoop: %s #%d read error: %s",
+				conn.remoteAddr, conn.messageCount, err.Error())
+			return
+		}
+		// Handler of Lock may be blocked, so Cancel takes effect here.
+		conn.addPending(request)
+		if request.GetType() == dlock.RequestType_Cancel {
+			conn.cancelPending(request.Cancel.GetId())
+		}
+		conn.Rch <- request
+	}
+}
+
+func (conn *Connection) getIdleTimeout() time.Duration {
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	return conn.idleTimeout
+}
+
+func (conn *Connection) setIdleTimeout(d time.Duration) {
+	conn.lk.Lock()
+	conn.idleTimeout = d
+	conn.lk.Unlock()
+}
+
+// Returns channels of handlers in flight which share keys with request
+// and makes done the last one for its keys.
+func (conn *Connection) orderKeys(request *dlock.Request, done chan bool) []chan bool {
+	if request.Lock == nil {
+		return nil
+	}
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	after := make([]chan bool, 0)
+	for _, key := range request.Lock.Keys {
+		if ch, ok := conn.keyOrder[key]; ok {
+			after = append(after, ch)
+		}
+		conn.keyOrder[key] = done
+	}
+	return after
+}
+
+// Lets requests waiting for keys of request run, see orderKeys.
+func (conn *Connection) finishKeys(request *dlock.Request, done chan bool) {
+	close(done)
+	if request.Lock == nil {
+		return
+	}
+	conn.lk.Lock()
+	for _, key := range request.Lock.Keys {
+		if conn.keyOrder[key] == done {
+			delete(conn.keyOrder, key)
+		}
+	}
+	conn.lk.Unlock()
+}
+
+// Registers request id, so that Cancel may stop it, see pendingCancel.
+// Request reusing id of one in flight is not registered, see isPending.
+func (conn *Connection) addPending(request *dlock.Request) {
+	if request.Id == 0 {
+		return
+	}
+	conn.lk.Lock()
+	if _, ok := conn.pending[request.Id]; !ok {
+		conn.pending[request.Id] = &pendingRequest{cancel: make(chan bool), request: request}
+	}
+	conn.lk.Unlock()
+}
+
+// Tells whether request owns its id, false if other request
+// with the same id was in flight when it arrived.
+func (conn *Connection) isPending(request *dlock.Request) bool {
+	if request.Id == 0 {
+		return true
+	}
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	p, ok := conn.pending[request.Id]
+	return ok && p.request == request
+}
+
+// Returns channel closed by Cancel of request id, nil if id is 0.
+func (conn *Connection) pendingCancel(id uint64) <-chan bool {
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	if p, ok := conn.pending[id]; ok {
+		return p.cancel
+	}
+	return nil
+}
+
+// Forgets request after its handler has returned.
+func (conn *Connection) finishPending(request *dlock.Request) {
+	conn.lk.Lock()
+	if p, ok := conn.pending[request.Id]; ok && p.request == request {
+		delete(conn.pending, request.Id)
+	}
+	conn.lk.Unlock()
+}
+
+func (conn *Connection) cancelPending(id uint64) {
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	p, ok := conn.pending[id]
+	if !ok {
+		return
+	}
+	select {
+	case <-p.cancel:
+	default:
+		close(p.cancel)
+	}
+}
+
+// Queues unsolicited message. It is sent between responses
+// without waiting for them, so it never blocks.
+func (conn *Connection) pushEvent(response *dlock.Response) {
+	conn.lk.Lock()
+	conn.events = append(conn.events, response)
+	conn.lk.Unlock()
+	select {
+	case conn.eventSignal <- true:
+	default:
+	}
+}
+
+func (conn *Connection) takeEvents() []*dlock.Response {
+	conn.lk.Lock()
+	defer conn.lk.Unlock()
+	events := conn.events
+	conn.events = nil
+	return events
+}
+
+func (conn *Connection) writeLoop() {
+	defer conn.ioWait.Done()
+
+	for {
+		select {
+		case response, ok := <-conn.Wch:
+			if !ok {
+				return
+			}
+			if err := conn.send(conn.server.commitResponse(conn, response)); err != nil {
+				return
+			}
+		case <-conn.eventSignal:
+			for _, response := range conn.takeEvents() {
+				if err := conn.send(response); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (conn *Connection) send(response *dlock.Response) error {
+	conn.funResetWriteTimeout()
+	err := dlock.SendMessage(conn.w, response)
+	if err != nil {
+		log.Printf("Connection.writeLoop: %s #%d response.RequestId=%d response.Status=%s SendMessage() error: %s",
+			conn.remoteAddr, conn.messageCount, response.GetRequestId(), response.GetStatus().String(), err.Error())
+		return err
+	}
+
+	err = conn.w.Flush()
+	if err != nil {
+		log.Printf("Connection.writeLoop: %s #%d response.RequestId=%d response.Status=%s Flush() error: %s",
+			conn.remoteAddr, conn.messageCount, response.GetRequestId(), response.GetStatus().String(), err.Error())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"time"
+)
+
+// Edge of wait-for graph: waiter can not proceed until clientId
+// releases key or gets out of its wait queue.
+type waitEdge struct {
+	clientId string
+	key      string
+}
+
+// Returns clients w waits for. Holders and waiters queued before w
+// are taken into account, but not semaphore limits: any of the holders
+// may release a permit, so they do not make a cycle on their own.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeWaitEdges(w *lockWaiter, now *time.Time) []waitEdge {
+	edges := make([]waitEdge, 0)
+	add := func(key string, conflicts func(*KeyLock) bool) {
+		for _, kl := range server.unsafeTouchKey(key, now) {
+			if conflicts(kl) {
+				edges = append(edges, waitEdge{*kl.ClientId, key})
+			}
+		}
+		if ks, ok := server.keyLocks[key]; ok {
+			for _, other := range ks.waiters {
+				if w.isBehind(other) && conflicts(other.keyLock) {
+					edges = append(edges, waitEdge{*other.keyLock.ClientId, key})
+				}
+			}
+		}
+	}
+	for _, key := range w.keys {
+		add(key, w.keyLock.Conflicts)
+		if server.hierarchical != 0 {
+			for _, related := range server.unsafeRelatedKeys(key) {
+				add(related, w.keyLock.ConflictsNested)
+			}
+		}
+	}
+	return edges
+}
+
+// Looks for a cycle in wait-for graph which goes through queued w.
+// Returns keys along the cycle, or nil if there is none.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeFindDeadlock(w *lockWaiter, now *time.Time) []string {
+	start := *w.keyLock.ClientId
+	visited := make(map[string]bool)
+	var visit func(edges []waitEdge, path []string) []string
+	visit = func(edges []waitEdge, path []string) []string {
+		for _, e := range edges {
+			keys := append(path[:len(path):len(path)], e.key)
+			if e.clientId == start {
+				return keys
+			}
+			if visited[e.clientId] {
+				continue
+			}
+			visited[e.clientId] = true
+			for _, other := range server.clientWaiters[e.clientId] {
+				if cycle := visit(server.unsafeWaitEdges(other, now), keys); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		return nil
+	}
+
+	cycle := visit(server.unsafeWaitEdges(w, now), nil)
+	if cycle == nil {
+		return nil
+	}
+	result := make([]string, 0, len(cycle))
+	for _, key := range cycle {
+		if stringListFind(result, key) == -1 {
+			result = append(result, key)
+		}
+	}
+	return result
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"strings"
+	"time"
+)
+
+type HandlerFunc func(*Connection, *dlock.Request)
+
+func commonResponse(conn *Connection, request *dlock.Request) *dlock.Response {
+	return &dlock.Response{
+		Version:        dlock.ProtocolVersion,
+		RequestId:      request.Id,
+		Status:         dlock.ResponseStatus_Ok,
+		ServerUnixTime: time.Now().UnixNano(),
+	}
+}
+
+// Time when handling of request started.
+func responseTime(response *dlock.Response) time.Time {
+	return time.Unix(0, response.ServerUnixTime)
+}
+
+func handleUnknown(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	response.Status = dlock.ResponseStatus_InvalidType
+	conn.Wch <- response
+}
+
+func handleVersion(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	response.Status = dlock.ResponseStatus_Version
+	response.ErrorText = fmt.Sprintf("Protocol version %d is not supported, server speaks version %d",
+		request.GetVersion(), dlock.ProtocolVersion)
+	conn.Wch <- response
+}
+
+func handleUnauthorized(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	response.Status = dlock.ResponseStatus_Unauthorized
+	response.ErrorText = "Missing or invalid access_token"
+	conn.Wch <- response
+}
+
+// Client must not reuse id of request in flight.
+func handleDuplicate(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	response.Status = dlock.ResponseStatus_General
+	response.ErrorText = fmt.Sprintf("Request id %d is already in flight", request.Id)
+	conn.Wch <- response
+}
+
+func handleForbidden(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	response.Status = dlock.ResponseStatus_Forbidden
+	response.Keys = conn.deniedKeys(request)
+	response.ErrorText = fmt.Sprintf("Identity '%s' may not %s keys: %s",
+		conn.identity, strings.ToLower(request.GetType().String()), strings.Join(response.Keys, " "))
+	conn.Wch <- response
+}
+
+// Cluster follower redirects client to leader.
+func handleNotLeader(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	conn.server.setNotLeader(response)
+	conn.Wch <- response
+}
+
+func handlePing(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	conn.Wch <- response
+}
+
+func handleLock(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Lock == nil || len(request.Lock.Keys) == 0 {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+	if status, key, text := conn.server.checkKeys(request.Lock.Keys); status != dlock.ResponseStatus_Ok {
+		response.Status = status
+		response.ErrorText = text
+		if key != "" {
+			response.Keys = []string{key}
+		}
+		conn.Wch <- response
+		return
+	}
+
+	keyLock := conn.keyLock()
+	keyLock.Mode = request.Lock.GetMode()
+	keyLock.Limit = request.Lock.GetLimit()
+	keyLock.Hierarchical = request.Lock.GetHierarchical()
+	if keyLock.Limit != 0 {
+		// Semaphore is a shared lock with limited number of holders.
+		keyLock.Mode = dlock.LockMode_Shared
+	}
+	if request.Lock.GetReleaseMicro() != 0 {
+		keyLock.Expires = responseTime(response).Add(time.Duration(request.Lock.ReleaseMicro) * time.Microsecond)
+	}
+	waitTimeout := time.Duration(request.Lock.GetWaitMicro()) * time.Microsecond
+	cancel := conn.pendingCancel(request.Id)
+	failKeys, err := conn.server.lockKeys(request.Lock.Keys, keyLock, waitTimeout, cancel)
+	response.Keys = failKeys
+	if keyLock.Limit != 0 {
+		response.Holders = conn.server.keyHolders(request.Lock.Keys)
+	}
+	if err == dlock.ErrorLockAcquireTimeout {
+		response.Status = dlock.ResponseStatus_AcquireTimeout
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorLockDeadlock {
+		response.Status = dlock.ResponseStatus_Deadlock
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorLockCancelled {
+		response.Status = dlock.ResponseStatus_Cancelled
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorNotLeader {
+		conn.server.setNotLeader(response)
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorTooManyHeld {
+		response.Status = dlock.ResponseStatus_TooManyHeld
+		response.ErrorText = fmt.Sprintf("Client may hold at most %d keys", conn.server.options.MaxClientKeys)
+		conn.Wch <- response
+		return
+	}
+	if err != nil {
+		response.Status = dlock.ResponseStatus_General
+		response.ErrorText = err.Error()
+		conn.Wch <- response
+		return
+	}
+	response.FencingToken = keyLock.Token
+
+	conn.Wch <- response
+}
+
+// Wait of the named Lock has already been stopped by readLoop,
+// so that it does not depend on handlers queued before this one.
+// Whether keys were acquired is told by response to the Lock.
+func handleCancel(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	conn.Wch <- response
+}
+
+func handleExtend(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Lock == nil || len(request.Lock.Keys) == 0 || request.Lock.GetReleaseMicro() == 0 {
+		response.Status = dlock.ResponseStatus_General
+		response.ErrorText = "Extend requires keys and release_micro"
+		conn.Wch <- response
+		return
+	}
+
+	expires := responseTime(response).Add(time.Duration(request.Lock.ReleaseMicro) * time.Microsecond)
+	if notHeld := conn.server.extendKeys(request.Lock.Keys, &conn.clientId, expires); len(notHeld) > 0 {
+		response.Status = dlock.ResponseStatus_NotLocked
+		response.Keys = notHeld
+	}
+
+	conn.Wch <- response
+}
+
+func handleInspect(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Lock == nil || len(request.Lock.Keys) == 0 {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+
+	response.Locks = conn.server.inspectKeys(request.Lock.Keys)
+
+	conn.Wch <- response
+}
+
+func handleList(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.List == nil {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+
+	limit := int(request.List.GetLimit())
+	if limit == 0 {
+		limit = ListLimitDefault
+	} else if limit > ListLimitMax {
+		limit = ListLimitMax
+	}
+	locks, cursor := conn.server.listKeys(request.List.Prefix, request.List.Cursor, limit)
+	// Keys hidden by ACL are skipped, like released ones.
+	response.Locks = make([]*dlock.LockInfo, 0, len(locks))
+	for _, info := range locks {
+		if conn.server.options.ACL.Allowed(conn.identity, "list", info.Key) {
+			response.Locks = append(response.Locks, info)
+		}
+	}
+	response.Cursor = cursor
+
+	conn.Wch <- response
+}
+
+// Accepts features wanted by client which server supports and tells
+// server limits. Client which promises to ping often gets shorter idle
+// timeout, so that its locks are released soon after it dies.
+// Runs while no other requests are in flight, see Connection.loop.
+func handleHello(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	conn.name = request.Hello.GetName()
+	idleTimeout := conn.server.options.IdleTimeout
+	if heartbeat := time.Duration(request.Hello.GetHeartbeatMicro()) * time.Microsecond; heartbeat != 0 && 3*heartbeat < idleTimeout {
+		idleTimeout = 3 * heartbeat
+	}
+	conn.setIdleTimeout(idleTimeout)
+	// readLoop is already waiting for next request with old timeout.
+	conn.funResetIdleTimeout()
+	if conn.server.options.Debug {
+		log.Printf("handleHello: %s name='%s' features=%v idle_timeout=%s",
+			conn.remoteAddr, conn.name, request.Hello.GetFeatures(), idleTimeout)
+	}
+	response.MaxMessage = uint32(conn.server.options.MaxMessage)
+	response.MaxKeys = uint32(conn.server.options.MaxKeys)
+	response.IdleTimeoutMicro = uint64(idleTimeout / time.Microsecond)
+	for _, feature := range request.Hello.GetFeatures() {
+		switch feature {
+		case dlock.FeatureOutOfOrder:
+			conn.outOfOrder = true
+		default:
+			continue
+		}
+		response.Features = append(response.Features, feature)
+	}
+	conn.Wch <- response
+}
+
+func handleSession(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Session == nil {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+
+	grace := time.Duration(request.Session.GetGraceMicro()) * time.Microsecond
+	session, err := conn.server.openSession(conn, request.Session.GetId(), grace)
+	if err == ErrorSessionExpired {
+		response.Status = dlock.ResponseStatus_SessionExpired
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorNotLeader {
+		conn.server.setNotLeader(response)
+		conn.Wch <- response
+		return
+	}
+	if err == ErrorUnauthorized {
+		response.Status = dlock.ResponseStatus_Unauthorized
+		response.ErrorText = "Session belongs to other identity"
+		conn.Wch <- response
+		return
+	}
+	if err != nil {
+		response.Status = dlock.ResponseStatus_General
+		response.ErrorText = err.Error()
+		conn.Wch <- response
+		return
+	}
+	response.SessionId = session.Id
+	response.SessionGraceMicro = uint64(session.Grace / time.Microsecond)
+
+	conn.Wch <- response
+}
+
+func handleWatch(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Watch == nil {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+
+	conn.server.watchKeys(conn, request.Watch.Keys, request.Watch.Prefix)
+
+	conn.Wch <- response
+}
+
+func handleUnlock(conn *Connection, request *dlock.Request) {
+	response := commonResponse(conn, request)
+	if request.Lock == nil || len(request.Lock.Keys) == 0 {
+		response.Status = dlock.ResponseStatus_General
+		conn.Wch <- response
+		return
+	}
+
+	if notHeld := conn.server.unlockKeys(request.Lock.Keys, &conn.clientId); len(notHeld) > 0 {
+		response.Status = dlock.ResponseStatus_NotLocked
+		response.Keys = notHeld
+	}
+
+	conn.Wch <- response
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// When journal is flushed to disk.
+type FsyncPolicy int
+
+const (
+	FsyncInterval FsyncPolicy = iota // every Options.FsyncInterval, default
+	FsyncAlways                      // before response to each change of lease lock
+	FsyncNever                       // left to operating system
+)
+
+const (
+	journalLogName      = "leases.log"
+	journalSnapshotName = "leases.snapshot"
+
+	// Fencing tokens are reserved in blocks, so that a restarted server
+	// never issues tokens below those given out before.
+	journalFencingBlock = 1000
+
+	journalMaxRecord = 1 << 20
+)
+
+// Append-only log of lease lock changes and periodic snapshots of all leases.
+// Records are LockInfo messages: zero expires removes lock of client_id on key,
+// empty key reserves fencing tokens up to fencing_token.
+type journal struct {
+	closed  chan bool // closed when journalLoop is done
+	dir     string
+	dirty   bool     // written since last fsync, used by journalLoop
+	file    *os.File // used by journalLoop
+	fencing uint64   // reserved fencing tokens, protected by server.lk
+	policy  FsyncPolicy
+	stop    chan bool
+}
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "interval":
+		return FsyncInterval, nil
+	case "always":
+		return FsyncAlways, nil
+	case "never":
+		return FsyncNever, nil
+	}
+	return FsyncInterval, errors.New(fmt.Sprintf("Unknown fsync policy '%s', expected always, interval or never", s))
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "never"
+	}
+	return "interval"
+}
+
+// Restores lease locks from Options.DataDir and starts journaling.
+// Leases which have expired while server was down are dropped.
+// Does nothing without DataDir, in cluster or if journal is already open.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeOpenJournal() error {
+	if server.options.DataDir == "" || server.options.Cluster != "" || server.journal != nil {
+		return nil
+	}
+	if err := os.MkdirAll(server.options.DataDir, 0700); err != nil {
+		return err
+	}
+	j := &journal{
+		closed: make(chan bool),
+		dir:    server.options.DataDir,
+		policy: server.options.Fsync,
+		stop:   make(chan bool),
+	}
+	leases := make(map[string]*dlock.LockInfo)
+	for _, name := range []string{journalSnapshotName, journalLogName} {
+		if err := j.replay(name, leases); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	restored := 0
+	server.fencing = j.fencing
+	for _, info := range leases {
+		clientId := info.ClientId
+		created := time.Unix(0, info.Created)
+		expires := time.Unix(0, info.Expires)
+		if !expires.After(now) {
+			continue
+		}
+		kl := NewKeyLock(&clientId, &created, &expires)
+		kl.Identity = info.Identity
+		kl.Mode = info.Mode
+		kl.Limit = info.Limit
+		kl.Token = info.FencingToken
+		kl.Hierarchical = info.Hierarchical
+		ks := server.unsafeKeyState(info.Key)
+		ks.holders = keyLockListPut(ks.holders, kl)
+		if kl.Hierarchical {
+			server.hierarchical++
+		}
+		server.unsafeStartExpireTimer(info.Key, kl, &now)
+		restored++
+	}
+	log.Printf("Server.openJournal: %s restored %d leases, dropped %d expired, fencing=%d",
+		j.dir, restored, len(leases)-restored, server.fencing)
+
+	// Snapshot of restored state replaces old log.
+	server.journal = j
+	server.commits = newCommitQueue()
+	data, _ := server.unsafeJournalSnapshot()
+	if err := j.snapshot(data); err != nil {
+		server.journal = nil
+		server.commits = nil
+		return err
+	}
+	go server.journalLoop(j, server.commits)
+	return nil
+}
+
+// Applies records from file to leases, keyed by key and client id.
+// Missing file is empty. Incomplete record at the end, left by crash
+// during write, is ignored.
+func (j *journal) replay(name string, leases map[string]*dlock.LockInfo) error {
+	f, err := os.Open(filepath.Join(j.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		info := &dlock.LockInfo{}
+		err = dlock.ReadMessage(r, info, journalMaxRecord)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("journal.replay: %s record #%d is incomplete, ignored", name, n)
+			return nil
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s record #%d: %s", name, n, err.Error()))
+		}
+		if info.FencingToken > j.fencing {
+			j.fencing = info.FencingToken
+		}
+		if info.Key == "" {
+			continue
+		}
+		id := info.Key + "\x00" + info.ClientId
+		if info.Expires == 0 {
+			delete(leases, id)
+		} else {
+			leases[id] = info
+		}
+	}
+}
+
+// Writes queued records, flushes journal to disk and makes snapshots
+// in background until journal is closed. Files are only touched here,
+// without server.lk, so that lock traffic does not wait for disk.
+func (server *Server) journalLoop(j *journal, q *commitQueue) {
+	defer close(j.closed)
+	fsyncTicker := time.NewTicker(server.options.FsyncInterval)
+	defer fsyncTicker.Stop()
+	snapshotTicker := time.NewTicker(server.options.SnapshotInterval)
+	defer snapshotTicker.Stop()
+	for {
+		select {
+		case <-j.stop:
+			j.write(q)
+			j.sync()
+			if err := j.file.Close(); err != nil {
+				log.Printf("journal.close: %s", err.Error())
+			}
+			q.close()
+			return
+		case <-q.signal:
+			j.write(q)
+		case <-fsyncTicker.C:
+			if j.policy == FsyncInterval {
+				j.sync()
+			}
+		case <-snapshotTicker.C:
+			// Records queued before state is copied are in snapshot and
+			// may be written to new log once more with the same result.
+			server.lk.Lock()
+			data, count := server.unsafeJournalSnapshot()
+			server.lk.Unlock()
+			if err := j.snapshot(data); err != nil {
+				log.Printf("Server.journalLoop: snapshot error: %s", err.Error())
+			} else if server.options.Debug {
+				log.Printf("Server.journalLoop: snapshot %s leases=%d", j.dir, count)
+			}
+		}
+	}
+}
+
+// Records current state of lease lock kl on key, if it is a lease.
+// removed logs that lock is no longer held. In cluster, lock is replicated instead.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeJournal(key string, kl *KeyLock, removed bool) {
+	if server.cluster != nil {
+		server.unsafeReplicateLock(key, kl, removed)
+		return
+	}
+	if server.journal == nil || kl.Expires.IsZero() {
+		return
+	}
+	info := kl.Info(key)
+	if removed {
+		info.Expires = 0
+	}
+	server.unsafeJournalWrite(info.ClientId, info)
+}
+
+// Reserves next block of fencing tokens before server.fencing reaches
+// the reserved ones. Response to clientId, which is given the token, waits for it.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeJournalFencing(clientId string) {
+	if server.cluster != nil {
+		server.unsafeReplicateFencing(clientId)
+		return
+	}
+	j := server.journal
+	if j == nil || server.fencing < j.fencing {
+		return
+	}
+	j.fencing = server.fencing + journalFencingBlock
+	server.unsafeJournalWrite(clientId, &dlock.LockInfo{FencingToken: j.fencing})
+}
+
+// Queues record for journal goroutine, see commitResponse.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeJournalWrite(clientId string, info *dlock.LockInfo) {
+	var buf bytes.Buffer
+	if err := dlock.SendMessage(&buf, info); err != nil {
+		log.Printf("Server.journalWrite: key=%s encode error: %s", info.Key, err.Error())
+		return
+	}
+	server.unsafeCommit(clientId, buf.Bytes())
+}
+
+// Appends queued records to log and tells waiters about it.
+func (j *journal) write(q *commitQueue) {
+	records, last := q.take()
+	if len(records) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, record := range records {
+		buf.Write(record)
+	}
+	// Single write, so that crash leaves at most one incomplete record.
+	_, err := j.file.Write(buf.Bytes())
+	if err == nil {
+		j.dirty = true
+		if j.policy == FsyncAlways {
+			err = j.sync()
+		}
+	} else {
+		log.Printf("journal.write: records=%d write error: %s", len(records), err.Error())
+	}
+	q.done(last, err)
+}
+
+func (j *journal) sync() error {
+	if !j.dirty {
+		return nil
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Printf("journal.sync: fsync error: %s", err.Error())
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// Encodes all current leases for snapshot, returns them and their number.
+// Also reserves fencing tokens in snapshot and forgets written commits.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeJournalSnapshot() ([]byte, int) {
+	j := server.journal
+	now := time.Now()
+	var buf bytes.Buffer
+	j.fencing = server.fencing + journalFencingBlock
+	dlock.SendMessage(&buf, &dlock.LockInfo{FencingToken: j.fencing})
+	count := 0
+	for key, ks := range server.keyLocks {
+		for _, kl := range ks.holders {
+			if kl.Expires.IsZero() || !kl.Expires.After(now) {
+				continue
+			}
+			if err := dlock.SendMessage(&buf, kl.Info(key)); err != nil {
+				log.Printf("Server.journalSnapshot: key=%s encode error: %s", key, err.Error())
+				continue
+			}
+			count++
+		}
+	}
+	server.unsafePruneCommits()
+	return buf.Bytes(), count
+}
+
+// Writes data to new snapshot file and starts empty log.
+func (j *journal) snapshot(data []byte) error {
+	path := filepath.Join(j.dir, journalSnapshotName)
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := syncDir(j.dir); err != nil {
+		return err
+	}
+
+	// Records in old log are all in snapshot now.
+	file, err := os.OpenFile(filepath.Join(j.dir, journalLogName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.dirty = false
+	return nil
+}
+
+// Writes queued records, flushes and closes journal.
+// Lease locks are not journaled after that.
+func (server *Server) closeJournal() {
+	server.lk.Lock()
+	j := server.journal
+	server.journal = nil
+	server.lk.Unlock()
+	if j == nil {
+		return
+	}
+	close(j.stop)
+	<-j.closed
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Makes rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
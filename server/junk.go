@@ -0,0 +1,73 @@
+package server
+
+import (
+	"strings"
+)
+
+// Returns "a" and "a/b" for "a/b/c".
+func keyAncestors(key string) []string {
+	result := make([]string, 0, strings.Count(key, "/"))
+	for i := 1; i < len(key); i++ {
+		if key[i] == '/' {
+			result = append(result, key[:i])
+		}
+	}
+	return result
+}
+
+func stringListFind(a []string, s string) int {
+	for i := 0; i < len(a); i++ {
+		if a[i] == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// https://code.google.com/p/go-wiki/wiki/SliceTricks
+func stringListRemove(a []string, s string) []string {
+	for i := 0; i < len(a); i++ {
+		if a[i] == s {
+			copy(a[i:], a[i+1:])
+			a[len(a)-1] = ""
+			a = a[:len(a)-1]
+			break
+		}
+	}
+	return a
+}
+
+// Replaces lock of the same client or appends kl.
+func keyLockListPut(a []*KeyLock, kl *KeyLock) []*KeyLock {
+	for i := 0; i < len(a); i++ {
+		if a[i].IsSameClient(kl) {
+			a[i] = kl
+			return a
+		}
+	}
+	return append(a, kl)
+}
+
+func keyLockListRemove(a []*KeyLock, kl *KeyLock) []*KeyLock {
+	for i := 0; i < len(a); i++ {
+		if a[i] == kl {
+			copy(a[i:], a[i+1:])
+			a[len(a)-1] = nil
+			a = a[:len(a)-1]
+			break
+		}
+	}
+	return a
+}
+
+func lockWaiterListRemove(a []*lockWaiter, w *lockWaiter) []*lockWaiter {
+	for i := 0; i < len(a); i++ {
+		if a[i] == w {
+			copy(a[i:], a[i+1:])
+			a[len(a)-1] = nil
+			a = a[:len(a)-1]
+			break
+		}
+	}
+	return a
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const keyIndexMaxLevel = 32
+
+// Ordered set of keys for prefix lookups. It is a skip list
+// with its own lock, so scanning does not block other lock traffic.
+type KeyIndex struct {
+	head  keyIndexNode
+	level int
+	lk    sync.RWMutex
+	rnd   *rand.Rand
+	size  int
+}
+
+type keyIndexNode struct {
+	key  string
+	next []*keyIndexNode
+}
+
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{
+		head:  keyIndexNode{next: make([]*keyIndexNode, keyIndexMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (ix *KeyIndex) Insert(key string) {
+	ix.lk.Lock()
+	defer ix.lk.Unlock()
+
+	var update [keyIndexMaxLevel]*keyIndexNode
+	node := ix.findPath(key, &update)
+	if node != nil && node.key == key {
+		return
+	}
+
+	level := 1
+	for level < keyIndexMaxLevel && ix.rnd.Int31n(4) == 0 {
+		level++
+	}
+	for ; ix.level < level; ix.level++ {
+		update[ix.level] = &ix.head
+	}
+	node = &keyIndexNode{key: key, next: make([]*keyIndexNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	ix.size++
+}
+
+func (ix *KeyIndex) Len() int {
+	ix.lk.RLock()
+	defer ix.lk.RUnlock()
+	return ix.size
+}
+
+func (ix *KeyIndex) Remove(key string) {
+	ix.lk.Lock()
+	defer ix.lk.Unlock()
+
+	var update [keyIndexMaxLevel]*keyIndexNode
+	node := ix.findPath(key, &update)
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+	ix.size--
+}
+
+// Returns at most limit keys starting with prefix, in order, which are
+// greater than after. Empty after means from the beginning.
+func (ix *KeyIndex) Scan(prefix, after string, limit int) []string {
+	ix.lk.RLock()
+	defer ix.lk.RUnlock()
+
+	start := prefix
+	if after > start {
+		start = after
+	}
+	node := ix.findPath(start, nil)
+	if after != "" && node != nil && node.key == after {
+		node = node.next[0]
+	}
+	result := make([]string, 0)
+	for ; node != nil && len(result) < limit; node = node.next[0] {
+		if !strings.HasPrefix(node.key, prefix) {
+			break
+		}
+		result = append(result, node.key)
+	}
+	return result
+}
+
+// Returns first node with key >= key. If update is not nil,
+// fills it with rightmost nodes before key at each level.
+func (ix *KeyIndex) findPath(key string, update *[keyIndexMaxLevel]*keyIndexNode) *keyIndexNode {
+	x := &ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	ix := NewKeyIndex()
+	set := make(map[string]bool)
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%c/%d", 'a'+rnd.Intn(4), rnd.Intn(500))
+		if rnd.Intn(3) == 0 {
+			ix.Remove(key)
+			delete(set, key)
+		} else {
+			ix.Insert(key)
+			set[key] = true
+		}
+	}
+	if ix.Len() != len(set) {
+		t.Fatal("Len:", ix.Len(), "expected:", len(set))
+	}
+
+	expected := make([]string, 0)
+	for key := range set {
+		if key[0] == 'b' {
+			expected = append(expected, key)
+		}
+	}
+	sort.Strings(expected)
+
+	// Walk prefix in pages of 7.
+	got := make([]string, 0)
+	after := ""
+	for {
+		page := ix.Scan("b/", after, 7)
+		got = append(got, page...)
+		if len(page) < 7 {
+			break
+		}
+		after = page[len(page)-1]
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatal("Scan:", got, "expected:", expected)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"github.com/temoto/dlock/dlock"
+	"time"
+)
+
+type KeyLock struct {
+	ClientId *string
+	Created  time.Time
+	Expires  time.Time // IsZero() means delete on disconnect
+	Identity string    // of access token, empty without authentication
+	Mode     dlock.LockMode
+	Limit    uint32 // maximum number of holders, 0 means no limit
+	Token    uint64 // fencing token, assigned on acquisition
+
+	// Lock also covers ancestors and descendants of key, split by '/'.
+	Hierarchical bool
+
+	expireTimer *time.Timer
+}
+
+// Holders and FIFO queue of pending lock requests of a single key.
+type KeyState struct {
+	holders []*KeyLock
+	waiters []*lockWaiter
+}
+
+func NewKeyLock(clientId *string, now *time.Time, expires *time.Time) *KeyLock {
+	kl := &KeyLock{
+		ClientId: clientId,
+		Created:  *now,
+	}
+	if expires != nil {
+		kl.Expires = *expires
+	}
+	return kl
+}
+
+// Two locks conflict when they belong to different clients
+// and at least one of them is exclusive.
+func (k1 *KeyLock) Conflicts(k2 *KeyLock) bool {
+	if k1.IsSameClient(k2) {
+		return false
+	}
+	return k1.Mode == dlock.LockMode_Exclusive || k2.Mode == dlock.LockMode_Exclusive
+}
+
+// Locks on keys where one is ancestor of another conflict
+// only if at least one of them is hierarchical.
+func (k1 *KeyLock) ConflictsNested(k2 *KeyLock) bool {
+	return (k1.Hierarchical || k2.Hierarchical) && k1.Conflicts(k2)
+}
+
+// Checks whether kl may join holders of a key: it conflicts with none of them
+// and number of holders stays within the smallest limit among kl and them.
+func (kl *KeyLock) Admitted(holders []*KeyLock) bool {
+	limit := kl.Limit
+	others := uint32(0)
+	for _, other := range holders {
+		if other.IsSameClient(kl) {
+			continue
+		}
+		if other.Conflicts(kl) {
+			return false
+		}
+		others++
+		if other.Limit != 0 && (limit == 0 || other.Limit < limit) {
+			limit = other.Limit
+		}
+	}
+	return limit == 0 || others < limit
+}
+
+func (kl *KeyLock) Info(key string) *dlock.LockInfo {
+	info := &dlock.LockInfo{
+		Key:          key,
+		ClientId:     *kl.ClientId,
+		Created:      kl.Created.UnixNano(),
+		Mode:         kl.Mode,
+		FencingToken: kl.Token,
+		Identity:     kl.Identity,
+		Limit:        kl.Limit,
+		Hierarchical: kl.Hierarchical,
+	}
+	if !kl.Expires.IsZero() {
+		info.Expires = kl.Expires.UnixNano()
+	}
+	return info
+}
+
+func (k1 *KeyLock) IsSameClient(k2 *KeyLock) bool {
+	return (k1.ClientId == k2.ClientId) ||
+		(k1.ClientId != nil && *k1.ClientId == *k2.ClientId)
+}
+
+func (kl *KeyLock) stopExpireTimer() {
+	if kl.expireTimer != nil {
+		kl.expireTimer.Stop()
+		kl.expireTimer = nil
+	}
+}
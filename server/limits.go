@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"unicode/utf8"
+)
+
+var (
+	ErrorTooManyHeld = errors.New("TooManyHeld")
+)
+
+// Set of characters allowed in keys.
+type Charset struct {
+	spec   string
+	ranges [][2]rune
+}
+
+// Parses characters and ranges like "a-zA-Z0-9/_.-".
+// Dash at the beginning or end of spec stands for itself.
+func ParseCharset(spec string) (*Charset, error) {
+	chars := []rune(spec)
+	if len(chars) == 0 {
+		return nil, errors.New("Empty character set")
+	}
+	cs := &Charset{spec: spec}
+	for i := 0; i < len(chars); i++ {
+		lo, hi := chars[i], chars[i]
+		if i+2 < len(chars) && chars[i+1] == '-' {
+			hi = chars[i+2]
+			i += 2
+		}
+		if lo > hi {
+			return nil, errors.New(fmt.Sprintf("Invalid range %c-%c in character set '%s'", lo, hi, spec))
+		}
+		cs.ranges = append(cs.ranges, [2]rune{lo, hi})
+	}
+	return cs, nil
+}
+
+func (cs *Charset) Contains(r rune) bool {
+	for _, rng := range cs.ranges {
+		if r >= rng[0] && r <= rng[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (cs *Charset) String() string {
+	return cs.spec
+}
+
+// Checks keys of Lock request against MaxKeys, MaxKeyLength and KeyChars.
+// Returns Ok or error status with text naming the offending key.
+func (server *Server) checkKeys(keys []string) (dlock.ResponseStatus, string, string) {
+	if max := server.options.MaxKeys; max != 0 && uint(len(keys)) > max {
+		return dlock.ResponseStatus_TooManyKeys, "",
+			fmt.Sprintf("Request has %d keys, at most %d are allowed", len(keys), max)
+	}
+	for _, key := range keys {
+		if max := server.options.MaxKeyLength; max != 0 && uint(len(key)) > max {
+			return dlock.ResponseStatus_KeyTooLong, key,
+				fmt.Sprintf("Key '%s' is %d bytes long, at most %d are allowed", key, len(key), max)
+		}
+		if server.options.KeyChars == nil {
+			continue
+		}
+		for i, r := range key {
+			if r == utf8.RuneError || !server.options.KeyChars.Contains(r) {
+				return dlock.ResponseStatus_InvalidKey, key,
+					fmt.Sprintf("Key '%s' has character %q at byte %d, allowed are '%s'", key, r, i, server.options.KeyChars)
+			}
+		}
+	}
+	return dlock.ResponseStatus_Ok, "", ""
+}
+
+// Number of distinct keys client would hold if w was granted,
+// counting keys of its other waiters too.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeClientKeyCount(w *lockWaiter) uint {
+	clientId := *w.keyLock.ClientId
+	keys := make(map[string]bool)
+	for _, key := range server.clientLocks[clientId] {
+		keys[key] = true
+	}
+	for _, other := range server.clientWaiters[clientId] {
+		for _, key := range other.keys {
+			keys[key] = true
+		}
+	}
+	for _, key := range w.keys {
+		keys[key] = true
+	}
+	return uint(len(keys))
+}
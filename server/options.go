@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"strings"
+	"time"
+)
+
+// Server settings. Zero values mean defaults, see New.
+type Options struct {
+	ACL               *ACL   // nil allows everything
+	Bind              string // space separated host:port and unix:/path/to.sock, for Start
+	Cluster           string // space separated host:port of all cluster nodes, empty runs single server
+	ClusterAdvertise  string // address of this server for clients redirected by followers, default first of Bind
+	ClusterBind       string // host:port of this node, one of Cluster
+	ClusterSecret     string // shared by Cluster nodes to authenticate each other, required with Cluster
+	DataDir           string // journal of lease locks, or cluster log with Cluster; empty disables persistence
+	Debug             bool
+	ElectionTimeout   time.Duration // of cluster leader, default 1s
+	Fsync             FsyncPolicy   // of journal, default FsyncInterval
+	FsyncInterval     time.Duration // default 1s
+	IdleTimeout       time.Duration // default 60s
+	KeyChars          *Charset      // nil allows any characters in keys
+	MaxClientKeys     uint          // held and waited for by one client, 0 means no limit
+	MaxInflight       uint          // concurrent requests per connection with out of order responses, default 100
+	MaxKeyLength      uint          // bytes, 0 means no limit
+	MaxKeys           uint          // in one Lock request, 0 means no limit
+	MaxMessage        uint          // default 16KB
+	ReadBuffer        uint
+	ReadTimeout       time.Duration     // default 10s
+	SessionGrace      time.Duration     // default 1 minute
+	SnapshotInterval  time.Duration     // of journal, default 1 minute
+	TLS               *tls.Config       // nil means plain TCP
+	TLSClientIdentity bool              // use client certificate subject as identity, see tlsHandshake
+	Tokens            map[string]string // access token to identity, nil disables authentication
+	UnixGroup         string            // group of unix socket files, empty keeps default
+	UnixMode          os.FileMode       // permissions of unix socket files, default 0660
+	WriteTimeout      time.Duration     // default 10s
+}
+
+func (options *Options) setDefaults() {
+	if options.ClusterAdvertise == "" {
+		if addresses := strings.Fields(options.Bind); len(addresses) > 0 {
+			options.ClusterAdvertise = addresses[0]
+		}
+	}
+	if options.ElectionTimeout == 0 {
+		options.ElectionTimeout = time.Second
+	}
+	if options.FsyncInterval == 0 {
+		options.FsyncInterval = time.Second
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = 60 * time.Second
+	}
+	if options.MaxInflight == 0 {
+		options.MaxInflight = 100
+	}
+	if options.MaxMessage == 0 {
+		options.MaxMessage = 16 << 10
+	}
+	if options.ReadTimeout == 0 {
+		options.ReadTimeout = 10 * time.Second
+	}
+	if options.SessionGrace == 0 {
+		options.SessionGrace = time.Minute
+	}
+	if options.SnapshotInterval == 0 {
+		options.SnapshotInterval = time.Minute
+	}
+	if options.UnixMode == 0 {
+		options.UnixMode = 0660
+	}
+	if options.WriteTimeout == 0 {
+		options.WriteTimeout = 10 * time.Second
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pending Lock request. It sits in wait queues of all its keys
+// and is granted atomically when it reaches the front of each of them.
+type lockWaiter struct {
+	keys    []string
+	keyLock *KeyLock
+	queued  bool
+	result  chan error
+	seq     uint64 // order of arrival among all waiters
+}
+
+type lockWaiterBySeq []*lockWaiter
+
+func (a lockWaiterBySeq) Len() int           { return len(a) }
+func (a lockWaiterBySeq) Less(i, j int) bool { return a[i].seq < a[j].seq }
+func (a lockWaiterBySeq) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func newLockWaiter(keys []string, keyLock *KeyLock) *lockWaiter {
+	return &lockWaiter{
+		keys:    keys,
+		keyLock: keyLock,
+		result:  make(chan error, 1),
+	}
+}
+
+// Tells whether other came before w. New request comes after everyone queued.
+func (w *lockWaiter) isBehind(other *lockWaiter) bool {
+	return other != w && (!w.queued || other.seq < w.seq)
+}
+
+// Returns keys which prevent granting w right now:
+// held by conflicting lock or having conflicting waiter queued before w.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeBusyKeys(w *lockWaiter, now *time.Time) []string {
+	busyKeys := make([]string, 0)
+	for _, key := range w.keys {
+		if server.unsafeKeyBusy(key, w, now) {
+			busyKeys = append(busyKeys, key)
+		}
+	}
+	return busyKeys
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeKeyBusy(key string, w *lockWaiter, now *time.Time) bool {
+	if !w.keyLock.Admitted(server.unsafeTouchKey(key, now)) {
+		return true
+	}
+	if ks, ok := server.keyLocks[key]; ok {
+		for _, other := range ks.waiters {
+			if other == w {
+				break
+			}
+			if other.keyLock.Conflicts(w.keyLock) {
+				return true
+			}
+		}
+	}
+	// Without hierarchical locks, keys are independent.
+	if server.hierarchical == 0 && !w.keyLock.Hierarchical {
+		return false
+	}
+	for _, related := range server.unsafeRelatedKeys(key) {
+		for _, kl := range server.unsafeTouchKey(related, now) {
+			if kl.ConflictsNested(w.keyLock) {
+				return true
+			}
+		}
+		if ks, ok := server.keyLocks[related]; ok {
+			for _, other := range ks.waiters {
+				if w.isBehind(other) && other.keyLock.ConflictsNested(w.keyLock) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeGrantable(w *lockWaiter, now *time.Time) bool {
+	for _, key := range w.keys {
+		if server.unsafeKeyBusy(key, w, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// Makes w holder of all its keys and removes it from wait queues.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeGrant(w *lockWaiter, now *time.Time) {
+	if server.options.Debug {
+		log.Printf("Server.unsafeGrant keys='%s' client=%s",
+			strings.Join(w.keys, " "), *w.keyLock.ClientId)
+	}
+	server.unsafeDequeue(w)
+
+	// Single counter for all keys is strictly increasing for each of them too.
+	server.fencing++
+	server.unsafeJournalFencing(*w.keyLock.ClientId)
+	w.keyLock.Token = server.fencing
+
+	clientId := *w.keyLock.ClientId
+	clientLocks, _ := server.clientLocks[clientId]
+	for _, key := range w.keys {
+		ks := server.unsafeKeyState(key)
+		for _, old := range ks.holders {
+			if old.IsSameClient(w.keyLock) {
+				old.stopExpireTimer()
+				// Lease is replaced by lock until disconnect.
+				if w.keyLock.Expires.IsZero() {
+					server.unsafeJournal(key, old, true)
+				}
+				if old.Hierarchical {
+					server.hierarchical--
+				}
+			}
+		}
+
+		// Each key gets own copy to expire and extend independently.
+		kl := new(KeyLock)
+		*kl = *w.keyLock
+		server.unsafeStartExpireTimer(key, kl, now)
+		server.unsafeJournal(key, kl, false)
+		ks.holders = keyLockListPut(ks.holders, kl)
+		if kl.Hierarchical {
+			server.hierarchical++
+		}
+		server.unsafeNotify(dlock.EventType_Acquire, key, kl)
+
+		if stringListFind(clientLocks, key) == -1 {
+			clientLocks = append(clientLocks, key)
+		}
+	}
+	server.clientLocks[clientId] = clientLocks
+
+	w.result <- nil
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeEnqueue(w *lockWaiter) {
+	server.waiterSeq++
+	w.seq = server.waiterSeq
+	w.queued = true
+	for _, key := range w.keys {
+		ks := server.unsafeKeyState(key)
+		ks.waiters = append(ks.waiters, w)
+	}
+	server.clientWaiters[*w.keyLock.ClientId] = append(server.clientWaiters[*w.keyLock.ClientId], w)
+	if w.keyLock.Hierarchical {
+		server.hierarchical++
+	}
+}
+
+// Removes w from wait queues, if it is there.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeDequeue(w *lockWaiter) {
+	if !w.queued {
+		return
+	}
+	w.queued = false
+	if w.keyLock.Hierarchical {
+		server.hierarchical--
+	}
+	for _, key := range w.keys {
+		if ks, ok := server.keyLocks[key]; ok {
+			ks.waiters = lockWaiterListRemove(ks.waiters, w)
+			server.unsafeCleanKey(key)
+		}
+	}
+	clientId := *w.keyLock.ClientId
+	if waiters, ok := server.clientWaiters[clientId]; ok {
+		if waiters = lockWaiterListRemove(waiters, w); len(waiters) > 0 {
+			server.clientWaiters[clientId] = waiters
+		} else {
+			delete(server.clientWaiters, clientId)
+		}
+	}
+}
+
+// Returns ancestors and descendants of key which are held or waited for.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeRelatedKeys(key string) []string {
+	related := server.keyIndex.Scan(key+"/", "", len(server.keyLocks))
+	for _, ancestor := range keyAncestors(key) {
+		if _, ok := server.keyLocks[ancestor]; ok {
+			related = append(related, ancestor)
+		}
+	}
+	return related
+}
+
+// Grants locks to waiters of keys in order of arrival.
+// Call it after releasing holders or removing waiters of keys.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeWake(keys []string) {
+	now := time.Now()
+	for len(keys) > 0 {
+		waiters := server.unsafeKeyWaiters(keys)
+		keys = nil
+		for _, w := range waiters {
+			if !server.unsafeGrantable(w, &now) {
+				continue
+			}
+			server.unsafeGrant(w, &now)
+			// Queues of other keys of w have changed too.
+			keys = append(keys, w.keys...)
+		}
+	}
+}
+
+// Returns waiters of keys, and of their related keys in hierarchical mode,
+// in order of arrival.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeKeyWaiters(keys []string) []*lockWaiter {
+	seen := make(map[*lockWaiter]bool)
+	result := make([]*lockWaiter, 0)
+	add := func(key string) {
+		if ks, ok := server.keyLocks[key]; ok {
+			for _, w := range ks.waiters {
+				if !seen[w] {
+					seen[w] = true
+					result = append(result, w)
+				}
+			}
+		}
+	}
+	for _, key := range keys {
+		add(key)
+		if server.hierarchical != 0 {
+			for _, related := range server.unsafeRelatedKeys(key) {
+				add(related)
+			}
+		}
+	}
+	sort.Sort(lockWaiterBySeq(result))
+	return result
+}
@@ -0,0 +1,720 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lock server. Create it with New, then either Start listening on
+// Options.Bind addresses or Serve listeners created by caller.
+type Server struct {
+	clientCommits map[string]uint64 // last change of client queued for journal, see commitResponse
+	clientLocks   map[string][]string
+	clientWaiters map[string][]*lockWaiter
+	cluster       *cluster     // nil without Options.Cluster
+	commits       *commitQueue // nil without journal
+	connections   map[*Connection]bool
+	connSeq       uint64 // to name unix socket clients, atomic
+	fencing       uint64 // last issued fencing token
+	hierarchical  int    // number of hierarchical holders and waiters
+	isClosed      bool
+	journal       *journal  // nil without Options.DataDir
+	keyIndex      *KeyIndex // keyLocks keys in order
+	keyLocks      map[string]*KeyState
+	listeners     []net.Listener
+	lk            sync.Mutex
+	options       Options
+	sessions      map[string]*Session
+	waiterSeq     uint64
+	watchers      map[*Connection]*watchSpec
+	wg            sync.WaitGroup
+}
+
+const (
+	ListLimitDefault = 100
+	ListLimitMax     = 1000
+)
+
+var (
+	ErrorDuplicateClient = errors.New("DuplicateClient")
+	ErrorLockCancelled   = errors.New("LockCancelled")
+	ErrorLockDeadlock    = errors.New("LockDeadlock")
+	ErrorLockWaitAbort   = errors.New("LockWaitAbort")
+
+	ErrorIdleTimeout  = errors.New("IdleTimeout")
+	ErrorReadTimeout  = errors.New("ReadTimeout")
+	ErrorServerClosed = errors.New("ServerClosed")
+)
+
+// Creates server with options, zero values replaced by defaults.
+// Call Start or Serve to accept clients.
+func New(options Options) *Server {
+	options.setDefaults()
+	return &Server{
+		clientCommits: make(map[string]uint64),
+		clientLocks:   make(map[string][]string),
+		clientWaiters: make(map[string][]*lockWaiter),
+		connections:   make(map[*Connection]bool),
+		keyIndex:      NewKeyIndex(),
+		keyLocks:      make(map[string]*KeyState),
+		options:       options,
+		sessions:      make(map[string]*Session),
+		watchers:      make(map[*Connection]*watchSpec),
+	}
+}
+
+// Stops listening. Connected clients are served until they disconnect.
+func (server *Server) Close() {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	if !server.isClosed {
+		server.isClosed = true
+		for _, listener := range server.listeners {
+			listener.Close()
+		}
+	}
+}
+
+// Stops listening, disconnects all clients and waits until
+// their connections are finished or ctx is done. Then closes journal
+// and leaves cluster.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.Close()
+
+	server.lk.Lock()
+	conns := make([]*Connection, 0, len(server.connections))
+	for conn := range server.connections {
+		conns = append(conns, conn)
+	}
+	server.lk.Unlock()
+	for _, conn := range conns {
+		conn.funClose()
+	}
+
+	done := make(chan bool)
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+	defer server.closeJournal()
+	defer server.closeCluster()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Accepts connections on l until server is closed, then returns ErrorServerClosed.
+// Listener is closed along with the server. With Options.DataDir, lease locks
+// are restored before the first listener, errors of that are returned.
+// With Options.Cluster, server joins cluster then.
+func (server *Server) Serve(l net.Listener) error {
+	server.lk.Lock()
+	if server.isClosed {
+		server.lk.Unlock()
+		l.Close()
+		return ErrorServerClosed
+	}
+	if err := server.unsafeOpenJournal(); err != nil {
+		server.lk.Unlock()
+		l.Close()
+		return err
+	}
+	if err := server.unsafeOpenCluster(); err != nil {
+		server.lk.Unlock()
+		l.Close()
+		return err
+	}
+	server.listeners = append(server.listeners, l)
+	server.wg.Add(1)
+	server.lk.Unlock()
+
+	return server.listenLoop(l)
+}
+
+// Listens on Options.Bind addresses in background, returns number of listeners.
+// Returns 0 if lease locks could not be restored from Options.DataDir
+// or cluster could not be joined.
+func (server *Server) Start() int {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	if err := server.unsafeOpenJournal(); err != nil {
+		log.Printf("Server.Start: Error restoring leases from '%s': %s", server.options.DataDir, err.Error())
+		return 0
+	}
+	if err := server.unsafeOpenCluster(); err != nil {
+		log.Printf("Server.Start: Error joining cluster '%s': %s", server.options.Cluster, err.Error())
+		return 0
+	}
+
+	for _, address := range strings.Split(server.options.Bind, " ") {
+		address := strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		listener, err := server.listen(address)
+		if err != nil {
+			log.Printf("Server.Start: Error listening on '%s': %s", address, err.Error())
+			continue
+		}
+		if server.options.Debug {
+			log.Printf("Server.Start: bind to %s", listener.Addr().String())
+		}
+
+		server.listeners = append(server.listeners, listener)
+		server.wg.Add(1)
+		go server.listenLoop(listener)
+	}
+	return len(server.listeners)
+}
+
+// Opens listener for bind address: host:port or unix:/path/to.sock.
+func (server *Server) listen(address string) (net.Listener, error) {
+	if path := strings.TrimPrefix(address, "unix:"); path != address {
+		return server.listenUnix(path)
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (server *Server) Wait() {
+	server.wg.Wait()
+}
+
+func (server *Server) addConnection(netConn net.Conn) *Connection {
+	clientId := netConn.RemoteAddr().String()
+	tcpConn, isTCP := netConn.(*net.TCPConn)
+	if !isTCP {
+		// Unix socket peers are usually unnamed.
+		clientId = fmt.Sprintf("unix:%s#%d", netConn.LocalAddr().String(), atomic.AddUint64(&server.connSeq, 1))
+	}
+	var err error
+	if server.options.Debug {
+		log.Printf("Server.addConnection: %s", clientId)
+	}
+
+	// TODO: set expected clientLocks to average+1
+	if err = server.initClientLocks(clientId, 1); err != nil {
+		log.Printf("Server.addConnection: %s %s", clientId, err.Error())
+		return nil
+	}
+
+	if isTCP {
+		err = server.setupSocket(tcpConn)
+	} else {
+		err = netConn.SetReadDeadline(time.Now().Add(server.options.IdleTimeout))
+	}
+	if err != nil {
+		log.Printf("Server.addConnection: %s setupSocket error: %s", clientId, err.Error())
+		return nil
+	}
+
+	conn := NewConnection(server, clientId)
+	conn.handlers = map[dlock.RequestType]HandlerFunc{
+		dlock.RequestType_Ping:    handlePing,
+		dlock.RequestType_Lock:    handleLock,
+		dlock.RequestType_Unlock:  handleUnlock,
+		dlock.RequestType_Extend:  handleExtend,
+		dlock.RequestType_Inspect: handleInspect,
+		dlock.RequestType_List:    handleList,
+		dlock.RequestType_Session: handleSession,
+		dlock.RequestType_Watch:   handleWatch,
+		dlock.RequestType_Cancel:  handleCancel,
+		dlock.RequestType_Hello:   handleHello,
+	}
+	// TLS is only for network listeners.
+	if server.options.TLS != nil && isTCP {
+		tlsConn := tls.Server(tcpConn, server.options.TLS)
+		conn.funHandshake = func() error { return server.tlsHandshake(conn, tlsConn) }
+		netConn = tlsConn
+	}
+	conn.funClose = netConn.Close
+	conn.funResetIdleTimeout = func() error { return netConn.SetReadDeadline(time.Now().Add(conn.getIdleTimeout())) }
+	conn.funResetReadTimeout = func() error { return netConn.SetReadDeadline(time.Now().Add(server.options.ReadTimeout)) }
+	conn.funResetWriteTimeout = func() error { return netConn.SetWriteDeadline(time.Now().Add(server.options.WriteTimeout)) }
+
+	if server.options.ReadBuffer == 0 {
+		conn.r = bufio.NewReader(netConn)
+	} else {
+		conn.r = bufio.NewReaderSize(netConn, int(server.options.ReadBuffer))
+	}
+	conn.w = bufio.NewWriter(netConn)
+
+	server.lk.Lock()
+	server.connections[conn] = true
+	server.lk.Unlock()
+	server.wg.Add(1)
+	go conn.loop()
+
+	return conn
+}
+
+func (server *Server) removeConnection(conn *Connection) {
+	server.lk.Lock()
+	delete(server.connections, conn)
+	server.lk.Unlock()
+}
+
+// Completes TLS handshake of new connection. With Options.TLSClientIdentity,
+// subject common name of verified client certificate becomes its identity.
+func (server *Server) tlsHandshake(conn *Connection, tlsConn *tls.Conn) error {
+	if err := tlsConn.SetDeadline(time.Now().Add(server.options.ReadTimeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	if server.options.TLSClientIdentity {
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			conn.identity = certs[0].Subject.CommonName
+		}
+	}
+	return nil
+}
+
+// Sets new release time for keys held by client.
+// Nothing is changed if some keys are not held, they are returned.
+func (server *Server) extendKeys(keys []string, clientId *string, expires time.Time) []string {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	// Cluster follower changes nothing, response tells so, see commitResponse.
+	if server.unsafeFollower() {
+		return keys
+	}
+
+	now := time.Now()
+	notHeld := make([]string, 0)
+	found := make([]*KeyLock, len(keys))
+	for i, key := range keys {
+		for _, kl := range server.unsafeTouchKey(key, &now) {
+			if *kl.ClientId == *clientId {
+				found[i] = kl
+				break
+			}
+		}
+		if found[i] == nil {
+			notHeld = append(notHeld, key)
+		}
+	}
+	if len(notHeld) > 0 {
+		return notHeld
+	}
+
+	for i, key := range keys {
+		// Locks without release timeout are held until disconnect anyway.
+		if found[i].Expires.IsZero() {
+			continue
+		}
+		found[i].Expires = expires
+		server.unsafeStartExpireTimer(key, found[i], &now)
+		server.unsafeJournal(key, found[i], false)
+	}
+	return nil
+}
+
+// Timer callback, releases key if its lease has expired.
+func (server *Server) expireKey(key string) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	// Leases are expired by cluster leader.
+	if server.unsafeFollower() {
+		return
+	}
+	now := time.Now()
+	server.unsafeTouchKey(key, &now)
+	server.unsafeWake([]string{key})
+}
+
+// Returns info about each holder of keys.
+// Keys without holders are reported once with empty client id.
+func (server *Server) inspectKeys(keys []string) []*dlock.LockInfo {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	now := time.Now()
+	result := make([]*dlock.LockInfo, 0, len(keys))
+	for _, key := range keys {
+		infos := server.unsafeKeyInfo(key, &now)
+		if len(infos) == 0 {
+			waiters := 0
+			if ks, ok := server.keyLocks[key]; ok {
+				waiters = len(ks.waiters)
+			}
+			infos = append(infos, &dlock.LockInfo{Key: key, Waiters: uint32(waiters)})
+		}
+		result = append(result, infos...)
+	}
+	return result
+}
+
+// Returns info about holders of held keys starting with prefix, in key order.
+// Keys are taken from index without holding server.lk, at most limit of them,
+// those nobody holds are skipped. Returned cursor is the last scanned key
+// if there may be more.
+func (server *Server) listKeys(prefix, cursor string, limit int) ([]*dlock.LockInfo, string) {
+	keys := server.keyIndex.Scan(prefix, cursor, limit+1)
+	next := ""
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	now := time.Now()
+	result := make([]*dlock.LockInfo, 0, len(keys))
+	for _, key := range keys {
+		// Key could be released after scan, then it is skipped.
+		result = append(result, server.unsafeKeyInfo(key, &now)...)
+	}
+	return result, next
+}
+
+func (server *Server) keyHolders(keys []string) []*dlock.KeyHolders {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	now := time.Now()
+	result := make([]*dlock.KeyHolders, len(keys))
+	for i, key := range keys {
+		holders := server.unsafeTouchKey(key, &now)
+		result[i] = &dlock.KeyHolders{
+			Key:       key,
+			ClientIds: make([]string, len(holders)),
+		}
+		for j, kl := range holders {
+			result[i].ClientIds[j] = *kl.ClientId
+		}
+	}
+	return result
+}
+
+func (server *Server) initClientLocks(clientId string, cap int) error {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	if _, ok := server.clientLocks[clientId]; ok {
+		return ErrorDuplicateClient
+	}
+	server.clientLocks[clientId] = make([]string, 0, cap)
+
+	return nil
+}
+
+func (server *Server) listenLoop(l net.Listener) error {
+	defer server.wg.Done()
+	for {
+		netConn, err := l.Accept()
+		if server.closed() {
+			if err == nil {
+				netConn.Close()
+			}
+			return ErrorServerClosed
+		}
+		if err != nil {
+			log.Printf("Server.listenLoop: Accept() error: %s", err.Error())
+			return err
+		}
+
+		server.addConnection(netConn)
+	}
+}
+
+func (server *Server) closed() bool {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	return server.isClosed
+}
+
+// Waits at most timeout (0 means forever) until keys are granted or cancel is closed.
+// On timeout or cancel, returns keys which are still busy.
+func (server *Server) lockKeys(keys []string, keyLock *KeyLock, timeout time.Duration, cancel <-chan bool) ([]string, error) {
+	defer server.profileTime(fmt.Sprintf("Server.lockKeys keys='%s' client=%s mode=%s expires=%s timeout=%s",
+		strings.Join(keys, " "), *keyLock.ClientId, keyLock.Mode, keyLock.Expires, timeout), time.Now())
+	w := newLockWaiter(keys, keyLock)
+
+	server.lk.Lock()
+	// Client has disconnected; don't even try.
+	if _, ok := server.clientLocks[*keyLock.ClientId]; !ok {
+		server.lk.Unlock()
+		log.Printf("Server.lockKeys keys='%s' client=%s disconnected",
+			strings.Join(keys, " "), *keyLock.ClientId)
+		return nil, ErrorLockWaitAbort
+	}
+	if server.unsafeFollower() {
+		server.lk.Unlock()
+		return nil, ErrorNotLeader
+	}
+	now := time.Now()
+	// Cancel came before request was handled.
+	select {
+	case <-cancel:
+		server.lk.Unlock()
+		return nil, ErrorLockCancelled
+	default:
+	}
+	if max := server.options.MaxClientKeys; max != 0 && server.unsafeClientKeyCount(w) > max {
+		server.lk.Unlock()
+		return nil, ErrorTooManyHeld
+	}
+	if server.unsafeGrantable(w, &now) {
+		server.unsafeGrant(w, &now)
+		server.lk.Unlock()
+		return nil, <-w.result
+	}
+	server.unsafeEnqueue(w)
+	// New waiter is the victim, others have been waiting longer.
+	if cycleKeys := server.unsafeFindDeadlock(w, &now); cycleKeys != nil {
+		server.unsafeDequeue(w)
+		server.unsafeWake(keys)
+		server.lk.Unlock()
+		log.Printf("Server.lockKeys keys='%s' client=%s deadlock on keys='%s'",
+			strings.Join(keys, " "), *keyLock.ClientId, strings.Join(cycleKeys, " "))
+		return cycleKeys, ErrorLockDeadlock
+	}
+	server.lk.Unlock()
+
+	var timeoutCh <-chan time.Time
+	if timeout != 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	result := dlock.ErrorLockAcquireTimeout
+	select {
+	case err := <-w.result:
+		return nil, err
+	case <-timeoutCh:
+	case <-cancel:
+		result = ErrorLockCancelled
+	}
+
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	select {
+	// Granted or aborted while we were waiting for server.lk
+	case err := <-w.result:
+		return nil, err
+	default:
+	}
+	now = time.Now()
+	busyKeys := server.unsafeBusyKeys(w, &now)
+	server.unsafeDequeue(w)
+	// w could block waiters behind it.
+	server.unsafeWake(keys)
+	return busyKeys, result
+}
+
+func (server *Server) profileTime(tag string, t1 time.Time) {
+	d := time.Now().Sub(t1)
+	if server.options.Debug {
+		log.Printf("%s time=%s", tag, d)
+	}
+}
+
+func (server *Server) releaseClient(clientId *string) []string {
+	if server.options.Debug {
+		log.Printf("Server.releaseClient: %s", *clientId)
+	}
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	return server.unsafeReleaseClient(clientId)
+}
+
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeReleaseClient(clientId *string) []string {
+	keys, _ := server.clientLocks[*clientId]
+	delete(server.clientLocks, *clientId)
+
+	wakeKeys := server.unsafeAbortWaiters(*clientId)
+
+	// Only locks without release timeout are bound to connection.
+	for _, key := range keys {
+		if ks, ok := server.keyLocks[key]; ok {
+			for _, kl := range ks.holders {
+				if *kl.ClientId == *clientId && kl.Expires.IsZero() {
+					server.unsafeDeleteKey(key, kl, dlock.EventType_Release)
+					wakeKeys = append(wakeKeys, key)
+					break
+				}
+			}
+		}
+	}
+	server.unsafeWake(wakeKeys)
+
+	return keys
+}
+
+// Fails pending lock requests of client. Returns their keys.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeAbortWaiters(clientId string) []string {
+	keys := make([]string, 0)
+	waiters := server.clientWaiters[clientId]
+	delete(server.clientWaiters, clientId)
+	for _, w := range waiters {
+		server.unsafeDequeue(w)
+		w.result <- ErrorLockWaitAbort
+		keys = append(keys, w.keys...)
+	}
+	return keys
+}
+
+// Releases keys held by client, both with and without release timeout.
+// Returns keys which are not held by client.
+func (server *Server) unlockKeys(keys []string, clientId *string) []string {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	if server.unsafeFollower() {
+		return keys
+	}
+
+	now := time.Now()
+	notHeld := make([]string, 0)
+	for _, key := range keys {
+		released := false
+		for _, kl := range server.unsafeTouchKey(key, &now) {
+			if *kl.ClientId == *clientId {
+				server.unsafeDeleteKey(key, kl, dlock.EventType_Release)
+				released = true
+				break
+			}
+		}
+		if !released {
+			notHeld = append(notHeld, key)
+		}
+	}
+	server.unsafeWake(keys)
+	return notHeld
+}
+
+func (server *Server) setupSocket(conn *net.TCPConn) (err error) {
+	if err = conn.SetLinger(0); err != nil {
+		return
+	}
+	if server.options.ReadBuffer != 0 {
+		if err = conn.SetReadBuffer(int(server.options.ReadBuffer)); err != nil {
+			return
+		}
+	}
+	if err = conn.SetKeepAlive(true); err != nil {
+		return
+	}
+	if err = conn.SetReadDeadline(time.Now().Add(server.options.IdleTimeout)); err != nil {
+		return
+	}
+	return
+}
+
+// Deletes state of key if nobody holds or waits for it.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeCleanKey(key string) {
+	if ks, ok := server.keyLocks[key]; ok && len(ks.holders) == 0 && len(ks.waiters) == 0 {
+		delete(server.keyLocks, key)
+		server.keyIndex.Remove(key)
+	}
+}
+
+// Removes kl from holders of key and notifies watchers with event.
+// Does not grant the key to waiters, call unsafeWake after that.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeDeleteKey(key string, kl *KeyLock, event dlock.EventType) {
+	if server.options.Debug {
+		log.Printf("Server.unsafeDeleteKey key=%s kl.Expires=%s",
+			key, kl.Expires)
+	}
+	kl.stopExpireTimer()
+	server.unsafeJournal(key, kl, true)
+	if ks, ok := server.keyLocks[key]; ok {
+		ks.holders = keyLockListRemove(ks.holders, kl)
+		if kl.Hierarchical {
+			server.hierarchical--
+		}
+		server.unsafeCleanKey(key)
+		server.unsafeNotify(event, key, kl)
+	}
+	// Empty list is kept, it marks connected client.
+	if clientLocks, ok := server.clientLocks[*kl.ClientId]; ok {
+		server.clientLocks[*kl.ClientId] = stringListRemove(clientLocks, key)
+	}
+}
+
+// Returns info about each holder of key.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeKeyInfo(key string, now *time.Time) []*dlock.LockInfo {
+	holders := server.unsafeTouchKey(key, now)
+	if len(holders) == 0 {
+		return nil
+	}
+	waiters := len(server.keyLocks[key].waiters)
+	result := make([]*dlock.LockInfo, len(holders))
+	for i, kl := range holders {
+		result[i] = kl.Info(key)
+		result[i].Waiters = uint32(waiters)
+	}
+	return result
+}
+
+// Returns state of key, creating it if necessary.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeKeyState(key string) *KeyState {
+	ks, ok := server.keyLocks[key]
+	if !ok {
+		ks = &KeyState{}
+		server.keyLocks[key] = ks
+		server.keyIndex.Insert(key)
+	}
+	return ks
+}
+
+// (Re)starts timer which releases lease lock kl of key when it expires.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeStartExpireTimer(key string, kl *KeyLock, now *time.Time) {
+	kl.stopExpireTimer()
+	if kl.Expires.IsZero() {
+		return
+	}
+	kl.expireTimer = time.AfterFunc(kl.Expires.Sub(*now), func() { server.expireKey(key) })
+}
+
+// Releases expired holders of the key and returns the remaining ones.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeTouchKey(key string, expire *time.Time) []*KeyLock {
+	ks, ok := server.keyLocks[key]
+	if !ok {
+		return nil
+	}
+	for i := 0; i < len(ks.holders); {
+		kl := ks.holders[i]
+		if server.options.Debug {
+			log.Printf("Server.unsafeTouchKey key=%s expire=%s found; kl.Expires=%s",
+				key, expire, kl.Expires)
+		}
+		if !kl.Expires.IsZero() && expire.Sub(kl.Expires) >= 0 {
+			server.unsafeDeleteKey(key, kl, dlock.EventType_Expire)
+			continue
+		}
+		i++
+	}
+	return ks.holders
+}
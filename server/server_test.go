@@ -0,0 +1,1443 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/temoto/dlock/dlock"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertNil(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func initTestServer(t *testing.T, timeout time.Duration) *Server {
+	return startTestServer(t, Options{Bind: ":0", IdleTimeout: timeout, ReadTimeout: timeout, WriteTimeout: timeout})
+}
+
+func startTestServer(t *testing.T, options Options) *Server {
+	options.Debug = true
+	server := New(options)
+
+	n := server.Start()
+	if n != 1 {
+		t.Fatal("startTestServer: expected 1 listener, Server.Start():", n)
+	}
+
+	return server
+}
+
+func TestDuplicateClient(t *testing.T) {
+	server := initTestServer(t, 10*time.Millisecond)
+
+	netConn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	assertNil(err)
+	tcpConn := netConn.(*net.TCPConn)
+
+	// Let the server accept new connection
+	time.Sleep(1 * time.Millisecond)
+
+	if server.addConnection(tcpConn) == nil {
+		t.Fatal("Must add connection first time")
+	}
+	if server.addConnection(tcpConn) != nil {
+		t.Fatal("Must not add same connection twice")
+	}
+
+	ch := make(chan bool)
+	go func() {
+		server.Close()
+		server.Wait()
+		ch <- true
+	}()
+	select {
+	case <-ch:
+	case <-time.After(11 * time.Millisecond):
+		t.Fatal("Close timeout. Deadlock?")
+	}
+}
+
+func TestFunctionalLock01(t *testing.T) {
+	server := initTestServer(t, 10*time.Millisecond)
+
+	conn1, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	assertNil(err)
+	err = conn1.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	assertNil(err)
+
+	request1 := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys: []string{"q"},
+		},
+	}
+	err = dlock.SendMessage(conn1, request1)
+	assertNil(err)
+
+	response1 := &dlock.Response{}
+	err = dlock.ReadMessage(conn1, response1, server.options.MaxMessage)
+	assertNil(err)
+	if response1.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Status != Ok:", response1.GetStatus().String())
+	}
+
+	conn2, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	assertNil(err)
+	err = conn2.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	assertNil(err)
+
+	request2 := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys: []string{"q"},
+		},
+	}
+	err = dlock.SendMessage(conn2, request2)
+	assertNil(err)
+
+	conn1.Close()
+
+	response2 := &dlock.Response{}
+	err = dlock.ReadMessage(conn2, response2, server.options.MaxMessage)
+	assertNil(err)
+	if response1.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Status != Ok:", response1.GetStatus().String())
+	}
+}
+
+func TestFunctionalShared(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	shared := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys: []string{"q"},
+			Mode: dlock.LockMode_Shared,
+		},
+	}
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	if response := roundTrip(t, conn1, shared); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Shared lock 1 Status != Ok:", response.GetStatus().String())
+	}
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	if response := roundTrip(t, conn2, shared); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Shared lock 2 Status != Ok:", response.GetStatus().String())
+	}
+
+	conn3 := dialTest(t, server)
+	defer conn3.Close()
+	exclusive := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys:      []string{"q"},
+			WaitMicro: 5000,
+		},
+	}
+	if response := roundTrip(t, conn3, exclusive); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Exclusive lock Status != AcquireTimeout:", response.GetStatus().String())
+	}
+
+	// Writer gets the key when all readers are gone.
+	conn1.Close()
+	conn2.Close()
+	exclusive.Lock.WaitMicro = 50000
+	if response := roundTrip(t, conn3, exclusive); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Exclusive lock Status != Ok:", response.GetStatus().String())
+	}
+
+	// And blocks new readers.
+	conn4 := dialTest(t, server)
+	defer conn4.Close()
+	shared.Lock.WaitMicro = 5000
+	if response := roundTrip(t, conn4, shared); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Shared lock 3 Status != AcquireTimeout:", response.GetStatus().String())
+	}
+}
+
+func TestFencingToken(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	request := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys:         []string{"q"},
+			WaitMicro:    50000,
+			ReleaseMicro: 1000,
+		},
+	}
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	response1 := roundTrip(t, conn1, request)
+	if response1.GetStatus() != dlock.ResponseStatus_Ok || response1.GetFencingToken() == 0 {
+		t.Fatal("Lock 1 Status != Ok or no token:", response1.String())
+	}
+
+	// Lease of conn1 expires and conn2 takes the key.
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	response2 := roundTrip(t, conn2, request)
+	if response2.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock 2 Status != Ok:", response2.GetStatus().String())
+	}
+	if response2.GetFencingToken() <= response1.GetFencingToken() {
+		t.Fatal("Fencing token must increase:", response1.GetFencingToken(), response2.GetFencingToken())
+	}
+}
+
+func TestExtend(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	response := roundTrip(t, conn1, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys:         []string{"q"},
+			ReleaseMicro: 10000,
+		},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock Status != Ok:", response.GetStatus().String())
+	}
+	extend := &dlock.Request{
+		Type: dlock.RequestType_Extend,
+		Lock: &dlock.RequestLock{
+			Keys:         []string{"q"},
+			ReleaseMicro: 200000,
+		},
+	}
+	if response = roundTrip(t, conn1, extend); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Extend Status != Ok:", response.GetStatus().String())
+	}
+
+	// Original lease would be expired by now.
+	time.Sleep(20 * time.Millisecond)
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	response = roundTrip(t, conn2, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{
+			Keys:      []string{"q"},
+			WaitMicro: 5000,
+		},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Lock 2 Status != AcquireTimeout:", response.GetStatus().String())
+	}
+
+	// Only holder may extend.
+	response = roundTrip(t, conn2, extend)
+	if response.GetStatus() != dlock.ResponseStatus_NotLocked {
+		t.Fatal("Extend 2 Status != NotLocked:", response.GetStatus().String())
+	}
+	if len(response.Keys) != 1 || response.Keys[0] != "q" {
+		t.Fatal("Extend 2 Keys != [q]:", response.Keys)
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lock := func(conn net.Conn, release uint64, keys ...string) *dlock.Response {
+		return roundTrip(t, conn, &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: keys, ReleaseMicro: release, WaitMicro: 5000},
+		})
+	}
+	unlock := func(conn net.Conn, keys ...string) *dlock.Response {
+		return roundTrip(t, conn, &dlock.Request{
+			Type: dlock.RequestType_Unlock,
+			Lock: &dlock.RequestLock{Keys: keys},
+		})
+	}
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	if response := lock(conn1, 0, "a"); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock a Status != Ok:", response.GetStatus().String())
+	}
+	if response := lock(conn1, 1000000, "b"); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock b Status != Ok:", response.GetStatus().String())
+	}
+
+	// Other client can not unlock.
+	response := unlock(conn2, "a", "b")
+	if response.GetStatus() != dlock.ResponseStatus_NotLocked || len(response.Keys) != 2 {
+		t.Fatal("Unlock by other client must fail:", response.String())
+	}
+
+	// Holder releases both connection and lease locks, reports unknown key.
+	response = unlock(conn1, "a", "b", "c")
+	if response.GetStatus() != dlock.ResponseStatus_NotLocked || len(response.Keys) != 1 || response.Keys[0] != "c" {
+		t.Fatal("Unlock must fail only key c:", response.String())
+	}
+	if response := lock(conn2, 0, "a", "b"); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock a b after unlock Status != Ok:", response.GetStatus().String())
+	}
+
+	// Client without locks may lock again.
+	if response := lock(conn1, 0, "c"); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock c Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestFairQueue(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lockRequest := func(mode dlock.LockMode, wait uint64) *dlock.Request {
+		return &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{"q"}, Mode: mode, WaitMicro: wait},
+		}
+	}
+
+	reader1 := dialTest(t, server)
+	defer reader1.Close()
+	if response := roundTrip(t, reader1, lockRequest(dlock.LockMode_Shared, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Reader 1 Status != Ok:", response.GetStatus().String())
+	}
+
+	// Writer queues up behind reader1.
+	writer := dialTest(t, server)
+	defer writer.Close()
+	assertNil(dlock.SendMessage(writer, lockRequest(dlock.LockMode_Exclusive, 0)))
+	time.Sleep(5 * time.Millisecond)
+
+	// Reader2 is compatible with reader1, but must not overtake queued writer.
+	reader2 := dialTest(t, server)
+	defer reader2.Close()
+	if response := roundTrip(t, reader2, lockRequest(dlock.LockMode_Shared, 5000)); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Reader 2 Status != AcquireTimeout:", response.GetStatus().String())
+	}
+	assertNil(dlock.SendMessage(reader2, lockRequest(dlock.LockMode_Shared, 0)))
+	time.Sleep(5 * time.Millisecond)
+
+	reader1.Close()
+	response := &dlock.Response{}
+	assertNil(dlock.ReadMessage(writer, response, server.options.MaxMessage))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Writer Status != Ok:", response.GetStatus().String())
+	}
+
+	writer.Close()
+	response = &dlock.Response{}
+	assertNil(dlock.ReadMessage(reader2, response, server.options.MaxMessage))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Reader 2 Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	request := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"api"}, Limit: 2, WaitMicro: 5000},
+	}
+	conns := make([]net.Conn, 3)
+	for i := range conns {
+		conns[i] = dialTest(t, server)
+		defer conns[i].Close()
+	}
+	for i := 0; i < 2; i++ {
+		response := roundTrip(t, conns[i], request)
+		if response.GetStatus() != dlock.ResponseStatus_Ok {
+			t.Fatal("Lock", i, "Status != Ok:", response.GetStatus().String())
+		}
+		if len(response.Holders) != 1 || len(response.Holders[0].ClientIds) != i+1 {
+			t.Fatal("Lock", i, "expected", i+1, "holders:", response.Holders)
+		}
+	}
+	response := roundTrip(t, conns[2], request)
+	if response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Lock 3 Status != AcquireTimeout:", response.GetStatus().String())
+	}
+	if len(response.Holders) != 1 || len(response.Holders[0].ClientIds) != 2 {
+		t.Fatal("Lock 3 expected 2 holders:", response.Holders)
+	}
+
+	// Disconnect frees a permit.
+	conns[0].Close()
+	request.Lock.WaitMicro = 50000
+	if response := roundTrip(t, conns[2], request); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock 3 after disconnect Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestInspect(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lock := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"a"}, ReleaseMicro: 1000000},
+	}
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	if response := roundTrip(t, conn1, lock); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock Status != Ok:", response.GetStatus().String())
+	}
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	assertNil(dlock.SendMessage(conn2, lock))
+	time.Sleep(5 * time.Millisecond)
+
+	conn3 := dialTest(t, server)
+	defer conn3.Close()
+	response := roundTrip(t, conn3, &dlock.Request{
+		Type: dlock.RequestType_Inspect,
+		Lock: &dlock.RequestLock{Keys: []string{"a", "b"}},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok || len(response.Locks) != 2 {
+		t.Fatal("Inspect expected 2 locks:", response.String())
+	}
+	a, b := response.Locks[0], response.Locks[1]
+	if a.Key != "a" || a.ClientId != conn1.LocalAddr().String() || a.Waiters != 1 || a.Expires <= a.Created {
+		t.Fatal("Inspect a:", a.String())
+	}
+	if b.Key != "b" || b.ClientId != "" || b.Waiters != 0 {
+		t.Fatal("Inspect b:", b.String())
+	}
+}
+
+func TestList(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	response := roundTrip(t, conn1, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"billing/c", "billing/a", "other/x", "billing/b"}},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock Status != Ok:", response.GetStatus().String())
+	}
+
+	list := &dlock.Request{
+		Type: dlock.RequestType_List,
+		List: &dlock.RequestList{Prefix: "billing/", Limit: 2},
+	}
+	response = roundTrip(t, conn1, list)
+	if len(response.Locks) != 2 || response.Locks[0].Key != "billing/a" || response.Locks[1].Key != "billing/b" || response.Cursor != "billing/b" {
+		t.Fatal("List page 1:", response.String())
+	}
+	list.List.Cursor = response.Cursor
+	response = roundTrip(t, conn1, list)
+	if len(response.Locks) != 1 || response.Locks[0].Key != "billing/c" || response.Cursor != "" {
+		t.Fatal("List page 2:", response.String())
+	}
+
+	// Released keys disappear from index.
+	roundTrip(t, conn1, &dlock.Request{
+		Type: dlock.RequestType_Unlock,
+		Lock: &dlock.RequestLock{Keys: []string{"billing/a"}},
+	})
+	list.List.Cursor = ""
+	response = roundTrip(t, conn1, list)
+	if len(response.Locks) != 2 || response.Locks[0].Key != "billing/b" {
+		t.Fatal("List after unlock:", response.String())
+	}
+}
+
+func TestHierarchical(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lockRequest := func(key string, mode dlock.LockMode, hierarchical bool, wait uint64) *dlock.Request {
+		return &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{key}, Mode: mode, Hierarchical: hierarchical, WaitMicro: wait},
+		}
+	}
+
+	child := dialTest(t, server)
+	defer child.Close()
+	if response := roundTrip(t, child, lockRequest("db/users/42", dlock.LockMode_Exclusive, false, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Child Status != Ok:", response.GetStatus().String())
+	}
+
+	// Plain lock on parent does not look at children.
+	conn := dialTest(t, server)
+	defer conn.Close()
+	if response := roundTrip(t, conn, lockRequest("db/users", dlock.LockMode_Exclusive, false, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Flat parent Status != Ok:", response.GetStatus().String())
+	}
+	roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"db/users"}}})
+
+	parent := dialTest(t, server)
+	defer parent.Close()
+	if response := roundTrip(t, parent, lockRequest("db/users", dlock.LockMode_Exclusive, true, 5000)); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Parent Status != AcquireTimeout:", response.GetStatus().String())
+	} else if len(response.Keys) != 1 || response.Keys[0] != "db/users" {
+		t.Fatal("Parent busy keys:", response.Keys)
+	}
+	if response := roundTrip(t, parent, lockRequest("db/other", dlock.LockMode_Exclusive, true, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Sibling Status != Ok:", response.GetStatus().String())
+	}
+
+	// Shared locks on parent and child do not conflict.
+	reader := dialTest(t, server)
+	defer reader.Close()
+	if response := roundTrip(t, reader, lockRequest("cache", dlock.LockMode_Shared, true, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Shared root Status != Ok:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn, lockRequest("cache/users/7", dlock.LockMode_Shared, false, 0)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Shared child Status != Ok:", response.GetStatus().String())
+	}
+	reader.Close()
+	conn.Close()
+
+	// Waiting parent is granted when child is released.
+	assertNil(dlock.SendMessage(parent, lockRequest("db/users", dlock.LockMode_Exclusive, true, 0)))
+	time.Sleep(5 * time.Millisecond)
+	child.Close()
+	response := &dlock.Response{}
+	assertNil(dlock.ReadMessage(parent, response, server.options.MaxMessage))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Parent Status != Ok:", response.GetStatus().String())
+	}
+
+	// Now child waits for parent.
+	child = dialTest(t, server)
+	defer child.Close()
+	if response := roundTrip(t, child, lockRequest("db/users/42", dlock.LockMode_Shared, false, 5000)); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Child Status != AcquireTimeout:", response.GetStatus().String())
+	}
+}
+
+func TestDeadlock(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lockRequest := func(key string) *dlock.Request {
+		return &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{key}},
+		}
+	}
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	if response := roundTrip(t, conn1, lockRequest("x")); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Status != Ok:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn2, lockRequest("y")); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 2 Status != Ok:", response.GetStatus().String())
+	}
+
+	// Client 1 holds x and waits for y.
+	assertNil(dlock.SendMessage(conn1, lockRequest("y")))
+	time.Sleep(5 * time.Millisecond)
+
+	response := roundTrip(t, conn2, lockRequest("x"))
+	if response.GetStatus() != dlock.ResponseStatus_Deadlock {
+		t.Fatal("Client 2 Status != Deadlock:", response.GetStatus().String())
+	}
+	if len(response.Keys) != 2 || response.Keys[0] != "x" || response.Keys[1] != "y" {
+		t.Fatal("Deadlock keys:", response.Keys)
+	}
+
+	// Victim gives up its lock, so the other client proceeds.
+	conn2.Close()
+	response = &dlock.Response{}
+	assertNil(dlock.ReadMessage(conn1, response, server.options.MaxMessage))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestSession(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	sessionRequest := func(id string) *dlock.Request {
+		return &dlock.Request{
+			Type:    dlock.RequestType_Session,
+			Session: &dlock.RequestSession{Id: id, GraceMicro: 30000},
+		}
+	}
+	lockRequest := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"s"}},
+	}
+	otherRequest := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"s"}, WaitMicro: 5000},
+	}
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	response := roundTrip(t, conn1, sessionRequest(""))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Open Status != Ok:", response.GetStatus().String())
+	}
+	sessionId := response.GetSessionId()
+	if sessionId == "" || response.GetSessionGraceMicro() != 30000 {
+		t.Fatal("Open session id:", sessionId, "grace:", response.GetSessionGraceMicro())
+	}
+	if response := roundTrip(t, conn1, lockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Session lock Status != Ok:", response.GetStatus().String())
+	}
+	conn1.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	// Locks of detached session are kept.
+	other := dialTest(t, server)
+	defer other.Close()
+	if response := roundTrip(t, other, otherRequest); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+		t.Fatal("Other Status != AcquireTimeout:", response.GetStatus().String())
+	}
+
+	// Resumed session owns its locks.
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	if response := roundTrip(t, conn2, sessionRequest(sessionId)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Resume Status != Ok:", response.GetStatus().String())
+	}
+	unlockRequest := &dlock.Request{Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"s"}}}
+	if response := roundTrip(t, conn2, unlockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Unlock Status != Ok:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn2, lockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Session lock Status != Ok:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn2, sessionRequest("")); response.GetStatus() != dlock.ResponseStatus_General {
+		t.Fatal("Second open Status != General:", response.GetStatus().String())
+	}
+
+	// Locks are released when grace period ends.
+	conn2.Close()
+	time.Sleep(40 * time.Millisecond)
+	if response := roundTrip(t, other, otherRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Other Status != Ok:", response.GetStatus().String())
+	}
+	conn3 := dialTest(t, server)
+	defer conn3.Close()
+	if response := roundTrip(t, conn3, sessionRequest(sessionId)); response.GetStatus() != dlock.ResponseStatus_SessionExpired {
+		t.Fatal("Resume Status != SessionExpired:", response.GetStatus().String())
+	}
+}
+
+func TestCancel(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	lockRequest := func(id uint64) *dlock.Request {
+		return &dlock.Request{
+			Id:   id,
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{"c"}},
+		}
+	}
+	cancelRequest := func(id, target uint64) *dlock.Request {
+		return &dlock.Request{
+			Id:     id,
+			Type:   dlock.RequestType_Cancel,
+			Cancel: &dlock.RequestCancel{Id: target},
+		}
+	}
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	if response := roundTrip(t, conn1, lockRequest(1)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Status != Ok:", response.GetStatus().String())
+	}
+
+	// Lock waiting without timeout is stopped by Cancel, even with other requests
+	// queued behind it. Responses still come in order of requests.
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	assertNil(dlock.SendMessage(conn2, lockRequest(5)))
+	time.Sleep(5 * time.Millisecond)
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{Id: 6, Type: dlock.RequestType_Ping}))
+	assertNil(dlock.SendMessage(conn2, cancelRequest(7, 5)))
+	expect := []struct {
+		id     uint64
+		status dlock.ResponseStatus
+	}{
+		{5, dlock.ResponseStatus_Cancelled},
+		{6, dlock.ResponseStatus_Ok},
+		{7, dlock.ResponseStatus_Ok},
+	}
+	for _, e := range expect {
+		response := &dlock.Response{}
+		assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+		if response.GetRequestId() != e.id || response.GetStatus() != e.status {
+			t.Fatalf("Expected response %d %s, got %d %s", e.id, e.status.String(),
+				response.GetRequestId(), response.GetStatus().String())
+		}
+	}
+
+	// Cancelled request does not wait in queue anymore.
+	response := roundTrip(t, conn1, &dlock.Request{
+		Type: dlock.RequestType_Inspect,
+		Lock: &dlock.RequestLock{Keys: []string{"c"}},
+	})
+	if len(response.Locks) != 1 || response.Locks[0].Waiters != 0 {
+		t.Fatal("Inspect: expected no waiters, got", response.Locks)
+	}
+
+	// Cancel of finished or unknown request is acknowledged and changes nothing.
+	if response := roundTrip(t, conn1, cancelRequest(8, 1)); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Late cancel Status != Ok:", response.GetStatus().String())
+	}
+	response = roundTrip(t, conn1, &dlock.Request{
+		Type: dlock.RequestType_Unlock,
+		Lock: &dlock.RequestLock{Keys: []string{"c"}},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Unlock Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestHello(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	conn := dialTest(t, server)
+	defer conn.Close()
+	response := roundTrip(t, conn, &dlock.Request{
+		Version: dlock.ProtocolVersion + 1,
+		Type:    dlock.RequestType_Hello,
+		Hello:   &dlock.RequestHello{Name: "test"},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Version {
+		t.Fatal("Future version Status != Version:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn, &dlock.Request{Version: 1, Type: dlock.RequestType_Ping}); response.GetStatus() != dlock.ResponseStatus_Version {
+		t.Fatal("Old version Status != Version:", response.GetStatus().String())
+	}
+
+	// Heartbeat of client shortens idle timeout.
+	response = roundTrip(t, conn, &dlock.Request{
+		Version: dlock.ProtocolVersion,
+		Type:    dlock.RequestType_Hello,
+		Hello:   &dlock.RequestHello{Name: "test", HeartbeatMicro: 10000},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Hello Status != Ok:", response.GetStatus().String())
+	}
+	if response.GetMaxMessage() != uint32(server.options.MaxMessage) || response.GetIdleTimeoutMicro() != 30000 {
+		t.Fatal("Hello max_message:", response.GetMaxMessage(), "idle_timeout_micro:", response.GetIdleTimeoutMicro())
+	}
+	time.Sleep(50 * time.Millisecond)
+	response = &dlock.Response{}
+	if err := dlock.SendMessage(conn, &dlock.Request{Type: dlock.RequestType_Ping}); err == nil {
+		err = dlock.ReadMessage(conn, response, server.options.MaxMessage)
+		if err == nil {
+			t.Fatal("Connection is alive after idle timeout")
+		}
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	conn1 := dialTest(t, server)
+	defer conn1.Close()
+	lockRequest := &dlock.Request{
+		Id:   1,
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"o"}},
+	}
+	if response := roundTrip(t, conn1, lockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Status != Ok:", response.GetStatus().String())
+	}
+
+	conn2 := dialTest(t, server)
+	defer conn2.Close()
+	response := roundTrip(t, conn2, &dlock.Request{
+		Type:  dlock.RequestType_Hello,
+		Hello: &dlock.RequestHello{Features: []string{"unknown", dlock.FeatureOutOfOrder}},
+	})
+	if len(response.Features) != 1 || response.Features[0] != dlock.FeatureOutOfOrder {
+		t.Fatal("Hello features:", response.Features)
+	}
+
+	// Ping is answered while Lock before it is waiting.
+	assertNil(dlock.SendMessage(conn2, lockRequest))
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{Id: 2, Type: dlock.RequestType_Ping}))
+	response = &dlock.Response{}
+	assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+	if response.GetRequestId() != 2 || response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Expected Ping response, got", response.GetRequestId(), response.GetStatus().String())
+	}
+	// Id of waiting Lock is not reused.
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{Id: 1, Type: dlock.RequestType_Ping}))
+	response = &dlock.Response{}
+	assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+	if response.GetRequestId() != 1 || response.GetStatus() != dlock.ResponseStatus_General {
+		t.Fatal("Expected duplicate Ping General, got", response.GetRequestId(), response.GetStatus().String())
+	}
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{
+		Id:     3,
+		Type:   dlock.RequestType_Cancel,
+		Cancel: &dlock.RequestCancel{Id: 1},
+	}))
+	statuses := make(map[uint64]dlock.ResponseStatus)
+	for i := 0; i < 2; i++ {
+		response := &dlock.Response{}
+		assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+		statuses[response.GetRequestId()] = response.GetStatus()
+	}
+	if statuses[1] != dlock.ResponseStatus_Cancelled || statuses[3] != dlock.ResponseStatus_Ok {
+		t.Fatal("Expected Lock Cancelled and Cancel Ok, got", statuses)
+	}
+
+	// Unlock of key waits for Lock of it before.
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{Id: 4, Type: dlock.RequestType_Lock, Lock: &dlock.RequestLock{Keys: []string{"o"}}}))
+	assertNil(dlock.SendMessage(conn2, &dlock.Request{Id: 5, Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"o"}}}))
+	time.Sleep(5 * time.Millisecond)
+	if response := roundTrip(t, conn1, &dlock.Request{Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"o"}}}); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Unlock Status != Ok:", response.GetStatus().String())
+	}
+	for _, id := range []uint64{4, 5} {
+		response := &dlock.Response{}
+		assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+		if response.GetRequestId() != id || response.GetStatus() != dlock.ResponseStatus_Ok {
+			t.Fatal("Expected response", id, "Ok, got", response.GetRequestId(), response.GetStatus().String())
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server := initTestServer(t, 100*time.Millisecond)
+	defer server.Close()
+
+	watcher := dialTest(t, server)
+	defer watcher.Close()
+	watchRequest := &dlock.Request{
+		Type:  dlock.RequestType_Watch,
+		Watch: &dlock.RequestWatch{Keys: []string{"w"}, Prefix: "p/"},
+	}
+	if response := roundTrip(t, watcher, watchRequest); response.GetStatus() != dlock.ResponseStatus_Ok || response.Event != nil {
+		t.Fatal("Watch Status != Ok:", response.GetStatus().String())
+	}
+
+	expectEvent := func(eventType dlock.EventType, key string) {
+		response := &dlock.Response{}
+		assertNil(dlock.ReadMessage(watcher, response, server.options.MaxMessage))
+		event := response.GetEvent()
+		if event == nil || event.Type != eventType || event.Key != key {
+			t.Fatal("Expected event", eventType.String(), key, "got:", event)
+		}
+	}
+
+	locker := dialTest(t, server)
+	defer locker.Close()
+	lockRequest := func(key string, release uint64) *dlock.Request {
+		return &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{key}, ReleaseMicro: release},
+		}
+	}
+	roundTrip(t, locker, lockRequest("other", 0))
+	roundTrip(t, locker, lockRequest("w", 0))
+	expectEvent(dlock.EventType_Acquire, "w")
+	roundTrip(t, locker, &dlock.Request{Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"w"}}})
+	expectEvent(dlock.EventType_Release, "w")
+	roundTrip(t, locker, lockRequest("p/1", 5000))
+	expectEvent(dlock.EventType_Acquire, "p/1")
+	expectEvent(dlock.EventType_Expire, "p/1")
+}
+
+func TestAccessToken(t *testing.T) {
+	tokensFile, err := ioutil.TempFile("", "dlock-tokens")
+	assertNil(err)
+	defer os.Remove(tokensFile.Name())
+	_, err = tokensFile.WriteString("# identity token\nci secret1\n\nops secret2\n")
+	assertNil(err)
+	tokensFile.Close()
+	tokens, err := LoadTokens(tokensFile.Name())
+	assertNil(err)
+	server := startTestServer(t, Options{Bind: ":0", IdleTimeout: 100 * time.Millisecond, Tokens: tokens})
+	defer server.Close()
+
+	conn := dialTest(t, server)
+	defer conn.Close()
+	lockRequest := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"a"}},
+	}
+	if response := roundTrip(t, conn, lockRequest); response.GetStatus() != dlock.ResponseStatus_Unauthorized {
+		t.Fatal("No token Status != Unauthorized:", response.GetStatus().String())
+	}
+	lockRequest.AccessToken = "wrong"
+	if response := roundTrip(t, conn, lockRequest); response.GetStatus() != dlock.ResponseStatus_Unauthorized {
+		t.Fatal("Wrong token Status != Unauthorized:", response.GetStatus().String())
+	}
+	lockRequest.AccessToken = "secret1"
+	if response := roundTrip(t, conn, lockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Valid token Status != Ok:", response.GetStatus().String())
+	}
+
+	// Connection is bound to identity of the first token.
+	inspectRequest := &dlock.Request{
+		Type:        dlock.RequestType_Inspect,
+		AccessToken: "secret2",
+		Lock:        &dlock.RequestLock{Keys: []string{"a"}},
+	}
+	if response := roundTrip(t, conn, inspectRequest); response.GetStatus() != dlock.ResponseStatus_Unauthorized {
+		t.Fatal("Other identity Status != Unauthorized:", response.GetStatus().String())
+	}
+	inspectRequest.AccessToken = "secret1"
+	response := roundTrip(t, conn, inspectRequest)
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Inspect Status != Ok:", response.GetStatus().String())
+	}
+	if len(response.Locks) != 1 || response.Locks[0].Identity != "ci" {
+		t.Fatal("Inspect locks:", response.Locks)
+	}
+}
+
+func TestACL(t *testing.T) {
+	aclFile, err := ioutil.TempFile("", "dlock-acl")
+	assertNil(err)
+	defer os.Remove(aclFile.Name())
+	_, err = aclFile.WriteString("ci lock,unlock ci/*\nci list ci/a*\n* inspect *\n")
+	assertNil(err)
+	aclFile.Close()
+	acl, err := LoadACL(aclFile.Name())
+	assertNil(err)
+	server := startTestServer(t, Options{
+		ACL:         acl,
+		Bind:        ":0",
+		IdleTimeout: 100 * time.Millisecond,
+		Tokens:      map[string]string{"secret1": "ci"},
+	})
+	defer server.Close()
+
+	conn := dialTest(t, server)
+	defer conn.Close()
+	request := func(requestType dlock.RequestType, keys ...string) *dlock.Request {
+		return &dlock.Request{
+			Type:        requestType,
+			AccessToken: "secret1",
+			Lock:        &dlock.RequestLock{Keys: keys},
+		}
+	}
+	if response := roundTrip(t, conn, request(dlock.RequestType_Lock, "ci/a/b")); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Allowed lock Status != Ok:", response.GetStatus().String())
+	}
+	response := roundTrip(t, conn, request(dlock.RequestType_Lock, "ci/x", "prod/db"))
+	if response.GetStatus() != dlock.ResponseStatus_Forbidden {
+		t.Fatal("Denied lock Status != Forbidden:", response.GetStatus().String())
+	}
+	if len(response.Keys) != 1 || response.Keys[0] != "prod/db" {
+		t.Fatal("Denied keys:", response.Keys)
+	}
+	if response := roundTrip(t, conn, request(dlock.RequestType_Extend, "ci/a/b")); response.GetStatus() != dlock.ResponseStatus_Forbidden {
+		t.Fatal("Denied extend Status != Forbidden:", response.GetStatus().String())
+	}
+	if response := roundTrip(t, conn, request(dlock.RequestType_Inspect, "prod/db")); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Allowed inspect Status != Ok:", response.GetStatus().String())
+	}
+
+	other := dialTest(t, server)
+	defer other.Close()
+	roundTrip(t, other, &dlock.Request{Type: dlock.RequestType_Lock, AccessToken: "secret1", Lock: &dlock.RequestLock{Keys: []string{"ci/c"}}})
+	response = roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_List, AccessToken: "secret1", List: &dlock.RequestList{}})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("List Status != Ok:", response.GetStatus().String())
+	}
+	if len(response.Locks) != 1 || response.Locks[0].Key != "ci/a/b" {
+		t.Fatal("List hidden keys:", response.Locks)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	caCert, caKey := testCertificate(t, "dlock test CA", nil, nil)
+	serverCert, serverKey := testCertificate(t, "localhost", caCert, caKey)
+	clientCert, clientKey := testCertificate(t, "client1", caCert, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	server := startTestServer(t, Options{
+		Bind:        "localhost:0",
+		IdleTimeout: 100 * time.Millisecond,
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		TLSClientIdentity: true,
+	})
+	defer server.Close()
+
+	conn, err := tls.Dial("tcp", server.listeners[0].Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	})
+	assertNil(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	if response := roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Lock, Lock: &dlock.RequestLock{Keys: []string{"t"}}}); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock Status != Ok:", response.GetStatus().String())
+	}
+	response := roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Inspect, Lock: &dlock.RequestLock{Keys: []string{"t"}}})
+	if len(response.Locks) != 1 || response.Locks[0].Identity != "client1" {
+		t.Fatal("Inspect locks:", response.Locks)
+	}
+
+	// Client without certificate is refused.
+	conn2, err := tls.Dial("tcp", server.listeners[0].Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err == nil {
+		defer conn2.Close()
+		conn2.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		if err = dlock.SendMessage(conn2, &dlock.Request{Type: dlock.RequestType_Ping}); err == nil {
+			err = dlock.ReadMessage(conn2, &dlock.Response{}, server.options.MaxMessage)
+		}
+	}
+	if err == nil {
+		t.Fatal("Connection without client certificate must fail")
+	}
+}
+
+// Returns certificate signed by parent, or self-signed CA if parent is nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNil(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assertNil(err)
+	cert, err := x509.ParseCertificate(der)
+	assertNil(err)
+	return cert, key
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dlock.sock")
+
+	server := startTestServer(t, Options{Bind: "unix:" + path, IdleTimeout: 100 * time.Millisecond, UnixMode: 0600})
+	defer server.Close()
+	fi, err := os.Stat(path)
+	assertNil(err)
+	if fi.Mode().Perm() != 0600 {
+		t.Fatal("Socket file mode:", fi.Mode())
+	}
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("unix", path)
+		assertNil(err)
+		conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+		return conn
+	}
+	lockRequest := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"u"}, WaitMicro: 50000},
+	}
+	conn1 := dial()
+	defer conn1.Close()
+	if response := roundTrip(t, conn1, lockRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 1 Status != Ok:", response.GetStatus().String())
+	}
+
+	// Locks are released on disconnect, as with TCP.
+	conn2 := dial()
+	defer conn2.Close()
+	assertNil(dlock.SendMessage(conn2, lockRequest))
+	time.Sleep(5 * time.Millisecond)
+	conn1.Close()
+	response := &dlock.Response{}
+	assertNil(dlock.ReadMessage(conn2, response, server.options.MaxMessage))
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Client 2 Status != Ok:", response.GetStatus().String())
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	assertNil(err)
+	server := New(Options{IdleTimeout: time.Second})
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assertNil(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(100 * time.Millisecond))
+	request := &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"k"}},
+	}
+	if response := roundTrip(t, conn, request); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Status != Ok:", response.GetStatus().String())
+	}
+
+	// Shutdown disconnects the client well before its idle timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown:", err)
+	}
+	if err = <-served; err != ErrorServerClosed {
+		t.Fatal("Serve: expected ErrorServerClosed, got", err)
+	}
+	if err = server.Serve(listener); err != ErrorServerClosed {
+		t.Fatal("Serve after Shutdown: expected ErrorServerClosed, got", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	keyChars, err := ParseCharset("a-z/")
+	assertNil(err)
+	if _, err = ParseCharset("z-a"); err == nil {
+		t.Fatal("ParseCharset accepted reversed range")
+	}
+	server := startTestServer(t, Options{
+		Bind:          ":0",
+		KeyChars:      keyChars,
+		MaxClientKeys: 3,
+		MaxKeyLength:  8,
+		MaxKeys:       2,
+	})
+	defer server.Close()
+
+	conn := dialTest(t, server)
+	defer conn.Close()
+	if response := roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Hello, Hello: &dlock.RequestHello{}}); response.GetMaxKeys() != 2 {
+		t.Fatal("Hello max_keys:", response.GetMaxKeys())
+	}
+	check := func(keys []string, status dlock.ResponseStatus, failKey string) {
+		response := roundTrip(t, conn, &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: keys},
+		})
+		if response.GetStatus() != status {
+			t.Fatalf("Lock %v Status: expected %s, got %s %s", keys, status, response.GetStatus(), response.GetErrorText())
+		}
+		if failKey != "" && (len(response.Keys) != 1 || response.Keys[0] != failKey || !strings.Contains(response.GetErrorText(), failKey)) {
+			t.Fatalf("Lock %v: expected key %s in response, got %v '%s'", keys, failKey, response.Keys, response.GetErrorText())
+		}
+	}
+	check([]string{"a", "b", "c"}, dlock.ResponseStatus_TooManyKeys, "")
+	check([]string{"a", "longerthan8"}, dlock.ResponseStatus_KeyTooLong, "longerthan8")
+	check([]string{"a", "b/C"}, dlock.ResponseStatus_InvalidKey, "b/C")
+	check([]string{"a", "b"}, dlock.ResponseStatus_Ok, "")
+	// Keys already held are not counted twice.
+	check([]string{"a", "c"}, dlock.ResponseStatus_Ok, "")
+	check([]string{"d"}, dlock.ResponseStatus_TooManyHeld, "")
+	check([]string{"a", "b"}, dlock.ResponseStatus_Ok, "")
+
+	// Key held and waited for at once is counted once.
+	clientId, now := "limits", time.Now()
+	kl := NewKeyLock(&clientId, &now, nil)
+	server.lk.Lock()
+	server.clientLocks[clientId] = []string{"a"}
+	server.clientWaiters[clientId] = []*lockWaiter{newLockWaiter([]string{"a", "b"}, kl)}
+	count := server.unsafeClientKeyCount(newLockWaiter([]string{"b", "c"}, kl))
+	delete(server.clientLocks, clientId)
+	delete(server.clientWaiters, clientId)
+	server.lk.Unlock()
+	if count != 3 {
+		t.Fatal("unsafeClientKeyCount: expected 3, got", count)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	options := Options{Bind: ":0", DataDir: dir, Fsync: FsyncAlways}
+	shutdown := func(server *Server) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		assertNil(server.Shutdown(ctx))
+	}
+	request := func(conn net.Conn, requestType dlock.RequestType, key string, release uint64) *dlock.Response {
+		response := roundTrip(t, conn, &dlock.Request{
+			Type: requestType,
+			Lock: &dlock.RequestLock{Keys: []string{key}, ReleaseMicro: release, WaitMicro: 1000},
+		})
+		if response.GetStatus() != dlock.ResponseStatus_Ok {
+			t.Fatalf("%s %s Status != Ok: %s", requestType, key, response.GetStatus())
+		}
+		return response
+	}
+
+	server1 := startTestServer(t, options)
+	conn := dialTest(t, server1)
+	token := request(conn, dlock.RequestType_Lock, "a", 100000).FencingToken
+	// Response waits until change is written by journal goroutine.
+	if info, err := os.Stat(filepath.Join(dir, journalLogName)); err != nil || info.Size() == 0 {
+		t.Fatal("Lease lock not in journal before response:", info, err)
+	}
+	request(conn, dlock.RequestType_Extend, "a", 1000000)
+	request(conn, dlock.RequestType_Lock, "expired", 10000)
+	request(conn, dlock.RequestType_Lock, "conn", 0)
+	request(conn, dlock.RequestType_Lock, "unlocked", 1000000)
+	request(conn, dlock.RequestType_Unlock, "unlocked", 0)
+	request(conn, dlock.RequestType_Lock, "relocked", 1000000)
+	request(conn, dlock.RequestType_Lock, "relocked", 0)
+	clientId := conn.LocalAddr().String()
+	conn.Close()
+	shutdown(server1)
+
+	// Crash in the middle of write leaves incomplete record.
+	f, err := os.OpenFile(filepath.Join(dir, journalLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	assertNil(err)
+	_, err = f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	assertNil(err)
+	assertNil(f.Close())
+	time.Sleep(20 * time.Millisecond)
+
+	// Restored from log, then from snapshot made on start.
+	for i := 0; i < 2; i++ {
+		server := startTestServer(t, options)
+		conn = dialTest(t, server)
+		response := roundTrip(t, conn, &dlock.Request{
+			Type: dlock.RequestType_Inspect,
+			Lock: &dlock.RequestLock{Keys: []string{"a", "expired", "conn", "unlocked", "relocked"}},
+		})
+		a := response.Locks[0]
+		if a.ClientId != clientId || a.FencingToken != token || a.Expires < a.Created+int64(900*time.Millisecond) {
+			t.Fatal("Lease lock not restored:", a.String())
+		}
+		for _, info := range response.Locks[1:] {
+			if info.ClientId != "" {
+				t.Fatal("Unexpected lock restored:", info.String())
+			}
+		}
+		lockRequest := &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{"a"}, WaitMicro: 1000},
+		}
+		if response = roundTrip(t, conn, lockRequest); response.GetStatus() != dlock.ResponseStatus_AcquireTimeout {
+			t.Fatal("Lock of restored lease Status != AcquireTimeout:", response.GetStatus().String())
+		}
+		if next := request(conn, dlock.RequestType_Lock, "b", 0).FencingToken; next <= token {
+			t.Fatal("Fencing token did not increase after restart:", token, next)
+		}
+		conn.Close()
+		shutdown(server)
+	}
+}
+
+func TestJournalWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	server := startTestServer(t, Options{Bind: ":0", DataDir: dir, Fsync: FsyncAlways})
+	defer server.Close()
+	conn := dialTest(t, server)
+	defer conn.Close()
+
+	// Writes to closed log file fail.
+	server.lk.Lock()
+	assertNil(server.journal.file.Close())
+	server.lk.Unlock()
+	response := roundTrip(t, conn, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"a"}, ReleaseMicro: 1000000},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_General {
+		t.Fatal("Lock with failed journal write Status != General:", response.String())
+	}
+	// Change of lock bound to connection is not journaled.
+	response = roundTrip(t, conn, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"b"}},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Lock without lease Status != Ok:", response.String())
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dlock")
+	assertNil(err)
+	defer os.RemoveAll(dir)
+	freeAddress := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assertNil(err)
+		defer l.Close()
+		return l.Addr().String()
+	}
+	peers := []string{freeAddress(), freeAddress(), freeAddress()}
+	servers := make([]*Server, len(peers))
+	for i, peer := range peers {
+		servers[i] = startTestServer(t, Options{
+			Bind:            freeAddress(),
+			Cluster:         strings.Join(peers, " "),
+			ClusterBind:     peer,
+			ClusterSecret:   "test",
+			DataDir:         filepath.Join(dir, fmt.Sprint(i)),
+			ElectionTimeout: 50 * time.Millisecond,
+			SessionGrace:    time.Second,
+		})
+		defer servers[i].Shutdown(context.Background())
+	}
+	pingRequest := &dlock.Request{Type: dlock.RequestType_Ping}
+	listRequest := &dlock.Request{Type: dlock.RequestType_List, List: &dlock.RequestList{}}
+	findLeader := func() int {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			for i, server := range servers {
+				if server == nil {
+					continue
+				}
+				conn := dialTest(t, server)
+				response := roundTrip(t, conn, listRequest)
+				conn.Close()
+				if response.GetStatus() == dlock.ResponseStatus_Ok {
+					return i
+				}
+			}
+		}
+		t.Fatal("No cluster leader elected")
+		return -1
+	}
+	lock := func(conn net.Conn, key string, release uint64) uint64 {
+		response := roundTrip(t, conn, &dlock.Request{
+			Type: dlock.RequestType_Lock,
+			Lock: &dlock.RequestLock{Keys: []string{key}, ReleaseMicro: release, WaitMicro: 1000},
+		})
+		if response.GetStatus() != dlock.ResponseStatus_Ok {
+			t.Fatalf("Lock %s Status != Ok: %s %s", key, response.GetStatus(), response.GetErrorText())
+		}
+		return response.FencingToken
+	}
+
+	leader := findLeader()
+	follower := (leader + 1) % len(servers)
+	conn := dialTest(t, servers[follower])
+	if response := roundTrip(t, conn, pingRequest); response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Follower response to Ping:", response.String())
+	}
+	response := roundTrip(t, conn, listRequest)
+	conn.Close()
+	if response.GetStatus() != dlock.ResponseStatus_NotLeader || response.GetLeader() != servers[leader].options.ClusterAdvertise {
+		t.Fatal("Follower response:", response.String())
+	}
+
+	conn = dialTest(t, servers[leader])
+	response = roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Session, Session: &dlock.RequestSession{}})
+	sessionId := response.GetSessionId()
+	sessionToken := lock(conn, "session", 0)
+	conn.Close()
+	conn = dialTest(t, servers[leader])
+	clientId := conn.LocalAddr().String()
+	leaseToken := lock(conn, "lease", 10000000)
+	lock(conn, "conn", 0)
+
+	// Old leader is gone, new one knows session and lease, but not lock bound to connection.
+	servers[leader].Shutdown(context.Background())
+	servers[leader] = nil
+	leader = findLeader()
+	conn = dialTest(t, servers[leader])
+	defer conn.Close()
+	response = roundTrip(t, conn, &dlock.Request{
+		Type: dlock.RequestType_Inspect,
+		Lock: &dlock.RequestLock{Keys: []string{"conn", "lease", "session"}},
+	})
+	expected := []struct {
+		clientId string
+		token    uint64
+	}{{"", 0}, {clientId, leaseToken}, {sessionId, sessionToken}}
+	for i, info := range response.Locks {
+		if info.ClientId != expected[i].clientId || info.FencingToken != expected[i].token {
+			t.Fatal("Unexpected lock after failover:", info.String())
+		}
+	}
+	if token := lock(conn, "conn", 0); token <= leaseToken {
+		t.Fatal("Fencing token did not increase after failover:", leaseToken, token)
+	}
+	response = roundTrip(t, conn, &dlock.Request{Type: dlock.RequestType_Session, Session: &dlock.RequestSession{Id: sessionId}})
+	if response.GetStatus() != dlock.ResponseStatus_General {
+		t.Fatal("Resume on connection with locks Status != General:", response.GetStatus())
+	}
+	conn2 := dialTest(t, servers[leader])
+	defer conn2.Close()
+	response = roundTrip(t, conn2, &dlock.Request{Type: dlock.RequestType_Session, Session: &dlock.RequestSession{Id: sessionId}})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Resume Status != Ok:", response.GetStatus())
+	}
+	response = roundTrip(t, conn2, &dlock.Request{Type: dlock.RequestType_Unlock, Lock: &dlock.RequestLock{Keys: []string{"session"}}})
+	if response.GetStatus() != dlock.ResponseStatus_Ok {
+		t.Fatal("Unlock after resume Status != Ok:", response.GetStatus())
+	}
+
+	// Leader cut off from the rest refuses to grant before they could elect another one.
+	for i, server := range servers {
+		if server != nil && i != leader {
+			server.closeCluster()
+		}
+	}
+	time.Sleep(30 * time.Millisecond)
+	conn3 := dialTest(t, servers[leader])
+	defer conn3.Close()
+	response = roundTrip(t, conn3, &dlock.Request{
+		Type: dlock.RequestType_Lock,
+		Lock: &dlock.RequestLock{Keys: []string{"partition"}, WaitMicro: 1000},
+	})
+	if response.GetStatus() != dlock.ResponseStatus_NotLeader {
+		t.Fatal("Lock on deposed leader Status != NotLeader:", response.GetStatus())
+	}
+}
+
+func dialTest(t *testing.T, server *Server) net.Conn {
+	conn, err := net.Dial("tcp", server.listeners[0].Addr().String())
+	assertNil(err)
+	assertNil(conn.SetDeadline(time.Now().Add(100 * time.Millisecond)))
+	return conn
+}
+
+func roundTrip(t *testing.T, conn net.Conn, request *dlock.Request) *dlock.Response {
+	assertNil(dlock.SendMessage(conn, request))
+	response := &dlock.Response{}
+	assertNil(dlock.ReadMessage(conn, response, 16<<10))
+	if response.GetRequestId() != request.GetId() {
+		t.Fatal("Response.RequestId != Request.Id:", response.GetRequestId(), request.GetId())
+	}
+	return response
+}
+
+func init() {
+	dlock.Debug = true
+	log.SetFlags(log.Flags() | log.Lmicroseconds)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// Named owner of locks which outlives connection. While detached,
+// its locks are kept for grace period waiting for client to reconnect.
+type Session struct {
+	Id       string
+	Grace    time.Duration
+	Identity string
+
+	conn    *Connection // nil while detached
+	expires time.Time   // of detached session, zero while attached
+	timer   *time.Timer // grace period of detached session
+}
+
+var (
+	ErrorSessionExpired = errors.New("SessionExpired")
+	ErrorSessionLocked  = errors.New("Session must be opened before acquiring locks")
+	ErrorSessionOpen    = errors.New("Session is already open on this connection")
+)
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Binds connection to new session, or to existing one if id is not empty.
+// Connection holding locks of its own can not switch to session.
+// If the session is attached to other connection, that one is closed:
+// most likely it is dead already and the server did not notice yet.
+func (server *Server) openSession(conn *Connection, id string, grace time.Duration) (*Session, error) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	if server.unsafeFollower() {
+		return nil, ErrorNotLeader
+	}
+	if conn.session != nil {
+		return nil, ErrorSessionOpen
+	}
+	keys, ok := server.clientLocks[conn.clientId]
+	if !ok {
+		return nil, ErrorLockWaitAbort
+	}
+	if len(keys) > 0 {
+		return nil, ErrorSessionLocked
+	}
+
+	var session *Session
+	if id == "" {
+		if grace == 0 || grace > server.options.SessionGrace {
+			grace = server.options.SessionGrace
+		}
+		session = &Session{Id: newSessionId(), Grace: grace, Identity: conn.identity}
+		server.sessions[session.Id] = session
+		server.clientLocks[session.Id] = make([]string, 0, 1)
+	} else {
+		if session, ok = server.sessions[id]; !ok {
+			return nil, ErrorSessionExpired
+		}
+		if session.Identity != conn.identity {
+			return nil, ErrorUnauthorized
+		}
+		session.stopTimer()
+		if old := session.conn; old != nil {
+			log.Printf("Server.openSession: %s takes session %s from %s",
+				conn.remoteAddr, session.Id, old.remoteAddr)
+			server.unsafeAbortWaiters(session.Id)
+			old.funClose()
+		}
+	}
+
+	delete(server.clientLocks, conn.clientId)
+	conn.clientId = session.Id
+	conn.session = session
+	session.conn = conn
+	session.expires = time.Time{}
+	server.unsafeReplicateSession(session, false)
+	return session, nil
+}
+
+// Called when connection goes away. Session locks are kept for grace period,
+// other locks without release timeout are released right away.
+func (server *Server) releaseConnection(conn *Connection) {
+	server.lk.Lock()
+	delete(server.watchers, conn)
+	session := conn.session
+	clientId := conn.clientId
+	if session == nil {
+		server.lk.Unlock()
+		server.releaseClient(&clientId)
+		return
+	}
+	defer server.lk.Unlock()
+
+	// Session was taken by other connection or detached already.
+	// Cluster follower keeps sessions as leader tells.
+	if session.conn != conn || server.sessions[session.Id] != session || server.unsafeFollower() {
+		return
+	}
+	if server.options.Debug {
+		log.Printf("Server.releaseConnection: %s detach session %s grace=%s",
+			conn.remoteAddr, session.Id, session.Grace)
+	}
+	now := time.Now()
+	session.conn = nil
+	session.expires = now.Add(session.Grace)
+	server.unsafeReplicateSession(session, false)
+	server.unsafeStartSessionTimer(session, &now)
+	// Nobody would receive result of pending requests.
+	server.unsafeWake(server.unsafeAbortWaiters(session.Id))
+}
+
+// Timer callback, releases locks of session if it is still detached.
+func (server *Server) expireSession(session *Session) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+	if session.conn != nil || server.sessions[session.Id] != session || server.unsafeFollower() {
+		return
+	}
+	delete(server.sessions, session.Id)
+	server.unsafeReplicateSession(session, true)
+
+	log.Printf("Server.expireSession: %s", session.Id)
+	server.unsafeReleaseClient(&session.Id)
+}
+
+// Expires detached session at session.expires.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeStartSessionTimer(session *Session, now *time.Time) {
+	session.stopTimer()
+	session.timer = time.AfterFunc(session.expires.Sub(*now), func() { server.expireSession(session) })
+}
+
+func (session *Session) stopTimer() {
+	if session.timer != nil {
+		session.timer.Stop()
+		session.timer = nil
+	}
+}
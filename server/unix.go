@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Listens on unix domain socket at path and sets Options.UnixMode
+// and UnixGroup on the socket file.
+func (server *Server) listenUnix(path string) (net.Listener, error) {
+	// Socket file left by previous run makes Listen fail. Don't touch it
+	// if someone still accepts connections there.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("Another server is listening on " + path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, server.options.UnixMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if server.options.UnixGroup != "" {
+		group, err := user.LookupGroup(server.options.UnixGroup)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		gid, err := strconv.Atoi(group.Gid)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err = os.Chown(path, -1, gid); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/temoto/dlock/dlock"
+	"strings"
+	"time"
+)
+
+// Keys which connection receives events about.
+type watchSpec struct {
+	identity string
+	keys     []string
+	prefix   string
+}
+
+func (ws *watchSpec) match(key string) bool {
+	return (ws.prefix != "" && strings.HasPrefix(key, ws.prefix)) || stringListFind(ws.keys, key) != -1
+}
+
+// Subscribes connection to events of keys and keys starting with prefix,
+// replacing previous subscription. Empty keys and prefix unsubscribe.
+func (server *Server) watchKeys(conn *Connection, keys []string, prefix string) {
+	server.lk.Lock()
+	defer server.lk.Unlock()
+
+	if len(keys) == 0 && prefix == "" {
+		delete(server.watchers, conn)
+		return
+	}
+	server.watchers[conn] = &watchSpec{identity: conn.identity, keys: keys, prefix: prefix}
+}
+
+// Pushes event about key to connections watching it.
+// This function must be called while holding server.lk lock.
+func (server *Server) unsafeNotify(eventType dlock.EventType, key string, kl *KeyLock) {
+	if len(server.watchers) == 0 {
+		return
+	}
+	event := &dlock.Event{
+		Type:         eventType,
+		Key:          key,
+		ClientId:     *kl.ClientId,
+		Time:         time.Now().UnixNano(),
+		Mode:         kl.Mode,
+		FencingToken: kl.Token,
+	}
+	for conn, ws := range server.watchers {
+		// Keys under prefix are checked by ACL one by one.
+		if ws.match(key) && server.options.ACL.Allowed(ws.identity, "watch", key) {
+			conn.pushEvent(&dlock.Response{Version: dlock.ProtocolVersion, Event: event})
+		}
+	}
+}